@@ -0,0 +1,298 @@
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Rotation is how a Dialer spreads connections over the addresses of a host
+type Rotation int
+
+const (
+	RotateRoundRobin Rotation = iota // start with the next address on every dial, at a random one for hosts outside the cache
+	RotateRandom                     // shuffle the addresses on every dial
+	RotateNone                       // always in the order of the answer
+)
+
+type DialerOption func(d *dialer)
+
+// WithAttemptDelay sets how long an attempt runs alone before the next address is raced
+// against it, default 250ms as recommended by RFC 8305
+func WithAttemptDelay(delay time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.attemptDelay = delay
+	}
+}
+
+// WithBadAddrTimeout sets how long an address that failed to connect is tried last, default 30s
+func WithBadAddrTimeout(timeout time.Duration) DialerOption {
+	return func(d *dialer) {
+		d.badTimeout = timeout
+	}
+}
+
+// WithRotation sets how connections are spread over the addresses, default RotateRoundRobin
+func WithRotation(rotation Rotation) DialerOption {
+	return func(d *dialer) {
+		d.rotation = rotation
+	}
+}
+
+// WithPreferIPv4 tries IPv4 addresses first instead of IPv6 ones
+func WithPreferIPv4() DialerOption {
+	return func(d *dialer) {
+		d.preferIPv4 = true
+	}
+}
+
+type dialer struct {
+	fwd          DialContextFunc
+	resolver     *Resolver
+	attemptDelay time.Duration
+	badTimeout   time.Duration
+	rotation     Rotation
+	preferIPv4   bool
+
+	mu   sync.Mutex
+	bad  map[string]time.Time // address to the end of its penalty
+	rand *rand.Rand
+}
+
+// Dialer returns a wrapped DialContext func that uses the provided dnsCache.
+//
+// It dials the Happy Eyeballs way of RFC 8305: the addresses of both families
+// are interleaved and raced, a new attempt starts whenever the previous one
+// failed or did not connect within the attempt delay. Addresses that failed
+// to connect are tried last for a while.
+func Dialer(fwd DialContextFunc, dnsCache *Resolver, opts ...DialerOption) DialContextFunc {
+	d := &dialer{
+		fwd:          fwd,
+		resolver:     dnsCache,
+		attemptDelay: 250 * time.Millisecond,
+		badTimeout:   30 * time.Second,
+		bad:          make(map[string]time.Time),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d.dial
+}
+
+func (d *dialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// Bogus. But just let the real dialer return an error rather than
+		// inventing a similar one.
+		return d.fwd(ctx, network, address)
+	}
+	ips, err := d.resolver.LookupIPs(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+	}
+
+	ips = d.order(host, filterNetwork(network, ips))
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address for %q", network, host)
+	}
+	if debug {
+		log.Printf("dnscache: dialing %s %v for %s", network, ips, address)
+	}
+	return d.race(ctx, network, port, ips)
+}
+
+type dialResult struct {
+	ip   net.IP
+	conn net.Conn
+	err  error
+}
+
+// race dials the addresses in order, staggered by the attempt delay, and returns the first connection
+func (d *dialer) race(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.fwd(ctx, network, net.JoinHostPort(ip.String(), port))
+			results <- dialResult{ip, conn, err}
+		}()
+	}
+
+	timer := time.NewTimer(d.attemptDelay)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.attemptDelay)
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(d.attemptDelay)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				d.markGood(res.ip)
+				go closeLate(results, pending)
+				return res.conn, nil
+			}
+
+			if ctx.Err() == nil {
+				d.markBad(res.ip)
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+				restart()
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// closeLate closes the connections of the attempts that lost the race
+func closeLate(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// order rotates the addresses of each family, interleaves the families and moves bad addresses last
+func (d *dialer) order(host string, ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var n int
+	var cached bool
+	if d.rotation == RotateRoundRobin {
+		n, cached = d.resolver.nextDial(host)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch d.rotation {
+	case RotateRoundRobin:
+		if !cached {
+			n = d.rand.Int()
+		}
+		v4, v6 = rotate(v4, n), rotate(v6, n)
+	case RotateRandom:
+		d.rand.Shuffle(len(v4), func(i, j int) { v4[i], v4[j] = v4[j], v4[i] })
+		d.rand.Shuffle(len(v6), func(i, j int) { v6[i], v6[j] = v6[j], v6[i] })
+	}
+
+	first, second := v6, v4
+	if d.preferIPv4 {
+		first, second = v4, v6
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+
+	now := time.Now()
+	good, bad := ordered[:0:0], []net.IP(nil)
+	for _, ip := range ordered {
+		key := ip.String()
+		if until, ok := d.bad[key]; ok {
+			if now.Before(until) {
+				bad = append(bad, ip)
+				continue
+			}
+			delete(d.bad, key)
+		}
+		good = append(good, ip)
+	}
+	return append(good, bad...)
+}
+
+func (d *dialer) markBad(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if len(d.bad) >= 1024 {
+		for key, until := range d.bad {
+			if !now.Before(until) {
+				delete(d.bad, key)
+			}
+		}
+	}
+	d.bad[ip.String()] = now.Add(d.badTimeout)
+}
+
+func (d *dialer) markGood(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.bad, ip.String())
+}
+
+// rotate returns ips starting at position n
+func rotate(ips []net.IP, n int) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	n %= len(ips)
+	return append(append([]net.IP(nil), ips[n:]...), ips[:n]...)
+}
+
+// filterNetwork drops the addresses a tcp4 or tcp6 network can not dial
+func filterNetwork(network string, ips []net.IP) []net.IP {
+	var want4 bool
+	switch network {
+	case "tcp4", "udp4", "ip4":
+		want4 = true
+	case "tcp6", "udp6", "ip6":
+	default:
+		return ips
+	}
+
+	filtered := ips[:0:0]
+	for _, ip := range ips {
+		if (ip.To4() != nil) == want4 {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
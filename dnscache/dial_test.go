@@ -0,0 +1,144 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDialer connects through net.Pipe, addresses listed in fail are refused
+// and those in hang block until the dial is canceled
+type fakeDialer struct {
+	mu       sync.Mutex
+	fail     map[string]bool
+	hang     map[string]bool
+	attempts []string
+}
+
+func (f *fakeDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	f.mu.Lock()
+	f.attempts = append(f.attempts, host)
+	fail, hang := f.fail[host], f.hang[host]
+	f.mu.Unlock()
+
+	switch {
+	case fail:
+		return nil, errors.New("connection refused")
+	case hang:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	c, s := net.Pipe()
+	s.Close()
+	return c, nil
+}
+
+func (f *fakeDialer) reset() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attempts := f.attempts
+	f.attempts = nil
+	return attempts
+}
+
+func newDialTest(ips ...string) (*fakeDialer, *Resolver) {
+	f := newFakeLookup()
+	var addrs []Addr
+	for _, ip := range ips {
+		addrs = append(addrs, addr(ip, time.Hour))
+	}
+	f.set("example.com", addrs...)
+	r, _ := newTestResolver(f)
+	return &fakeDialer{fail: map[string]bool{}, hang: map[string]bool{}}, r
+}
+
+func TestDialerInterleave(t *testing.T) {
+	fd, r := newDialTest("1.1.1.1", "1.1.1.2", "2001:db8::1", "2001:db8::2")
+	defer r.Close()
+	for _, ip := range []string{"1.1.1.1", "1.1.1.2", "2001:db8::1", "2001:db8::2"} {
+		fd.fail[ip] = true
+	}
+
+	dial := Dialer(fd.dial, r, WithRotation(RotateNone))
+	if _, err := dial(context.Background(), "tcp", "example.com:80"); err == nil {
+		t.Fatal("dial succeeded with all addresses refusing")
+	}
+	if got := strings.Join(fd.reset(), " "); got != "2001:db8::1 1.1.1.1 2001:db8::2 1.1.1.2" {
+		t.Fatalf("attempts: %s", got)
+	}
+
+	dial = Dialer(fd.dial, r, WithRotation(RotateNone), WithPreferIPv4())
+	dial(context.Background(), "tcp4", "example.com:80")
+	if got := strings.Join(fd.reset(), " "); got != "1.1.1.1 1.1.1.2" {
+		t.Fatalf("tcp4 attempts: %s", got)
+	}
+}
+
+func TestDialerHappyEyeballs(t *testing.T) {
+	fd, r := newDialTest("1.1.1.1", "1.1.1.2")
+	defer r.Close()
+	fd.hang["1.1.1.1"] = true
+
+	dial := Dialer(fd.dial, r, WithRotation(RotateNone), WithAttemptDelay(20*time.Millisecond))
+	start := time.Now()
+	conn, err := dial(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dial took %v behind a dead address", d)
+	}
+	if got := strings.Join(fd.reset(), " "); got != "1.1.1.1 1.1.1.2" {
+		t.Fatalf("attempts: %s", got)
+	}
+}
+
+func TestDialerBadAddr(t *testing.T) {
+	fd, r := newDialTest("1.1.1.1", "1.1.1.2")
+	defer r.Close()
+	fd.fail["1.1.1.1"] = true
+
+	dial := Dialer(fd.dial, r, WithRotation(RotateNone))
+	for i := 0; i < 2; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	// the second dial skipped the bad address
+	if got := strings.Join(fd.reset(), " "); got != "1.1.1.1 1.1.1.2 1.1.1.2" {
+		t.Fatalf("attempts: %s", got)
+	}
+}
+
+func TestDialerRoundRobin(t *testing.T) {
+	fd, r := newDialTest("1.1.1.1", "1.1.1.2", "1.1.1.3")
+	defer r.Close()
+
+	dial := Dialer(fd.dial, r)
+	for i := 0; i < 4; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if got := strings.Join(fd.reset(), " "); got != "1.1.1.1 1.1.1.2 1.1.1.3 1.1.1.1" {
+		t.Fatalf("attempts: %s", got)
+	}
+
+	// the position goes with the cache entry
+	r.mu.Lock()
+	r.removeLocked(r.ipCache["example.com"])
+	r.mu.Unlock()
+	if _, ok := r.nextDial("example.com"); ok {
+		t.Fatal("position kept after the host left the cache")
+	}
+}
@@ -1,6 +1,7 @@
 package dnscache
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"log"
@@ -33,37 +34,130 @@ func preferGoResolver() bool {
 // Get returns a caching Resolver singleton.
 func Get() *Resolver { return single }
 
+// Addr is a resolved address with the time to live of its record
+type Addr struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// LookupFunc resolves all addresses of host along with their record TTLs
+type LookupFunc func(ctx context.Context, host string) ([]Addr, error)
+
 // Resolver is a minimal DNS caching resolver.
 //
-// The TTL is always fixed for now. It's not intended for general use.
-// Cache entries are never cleaned up so it's intended that this is
-// only used with a fixed set of hostnames.
+// Every address of a host is cached until the first of their records expires.
+// A background cleaner, started with the first cached host, drops expired and
+// idle hosts until Close is called.
 type Resolver struct {
 	// Forward is the resolver to use to populate the cache.
 	// If nil, net.DefaultResolver is used.
 	Forward *net.Resolver
 
-	// TTL is how long to keep entries cached
+	// Lookup, if set, is used instead of Forward to populate the cache.
+	// Unlike Forward it reports the record TTLs, see DNSLookup.
+	Lookup LookupFunc
+
+	// TTL is how long to keep entries cached when the TTL of the records
+	// is unknown, i.e. when they come from Forward.
 	//
 	// If zero, a default (currently 10 minutes) is used.
 	TTL time.Duration
 
+	// MinTTL and MaxTTL bound the TTL of the records, zero means no bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
 	// UseLastGood controls whether a cached entry older than TTL is used
 	// if a refresh fails.
 	UseLastGood bool
 
+	// MaxHosts bounds the number of cached hosts, the least recently
+	// looked up are evicted beyond it. Zero means no bound.
+	MaxHosts int
+
+	// IdleTimeout is how long a host that is not looked up stays cached,
+	// also with UseLastGood.
+	//
+	// If zero, a default (currently 1 hour) is used.
+	IdleTimeout time.Duration
+
+	// CleanupInterval is how often the cleaner runs.
+	//
+	// If zero, a default (currently 1 minute) is used.
+	CleanupInterval time.Duration
+
+	// RefreshBefore makes hot hosts be looked up again in the background
+	// once they expire within RefreshBefore, so their lookups never block.
+	// Zero disables the refresh.
+	RefreshBefore time.Duration
+
+	// HotHits is how many cache hits since its last lookup make a host hot.
+	//
+	// If zero, a default (currently 2) is used.
+	HotHits int
+
+	// Hosts, if set, answers for its hosts before the cache, like /etc/hosts.
+	Hosts *Hosts
+
+	// NoCacheCIDRs are the networks whose answers are used but not cached,
+	// as a guard against captive portals. If nil, the private networks of
+	// RFC 1918 are used; an empty slice caches every answer.
+	NoCacheCIDRs []*net.IPNet
+
+	// CacheCIDRs are networks cached even when they are in NoCacheCIDRs,
+	// e.g. the private network of a datacenter.
+	CacheCIDRs []*net.IPNet
+
+	// NegativeTTL is how long a host that does not exist is remembered
+	// as such. Zero disables negative caching.
+	NegativeTTL time.Duration
+
 	sf singleflight.Group
 
 	mu      sync.Mutex
-	ipCache map[string]ipCacheEntry
+	ipCache map[string]*ipCacheEntry
+	lru     list.List // of *ipCacheEntry, most recently used first
+	stats   map[string]*HostStats
+	nxCache map[string]nxCacheEntry
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+
+	now func() time.Time // for tests
 }
 
 type ipCacheEntry struct {
-	ip      net.IP // either v4 or v6
-	ip6     net.IP // nil if no v4 or no v6
+	host     string
+	ips      []net.IP // in the order of the answer
+	expires  time.Time
+	lastUsed time.Time
+	elem     *list.Element
+
+	hits       int // since the last lookup
+	refreshing bool
+	dials      int // round robin position of the dialers
+}
+
+type nxCacheEntry struct {
+	err     error
 	expires time.Time
 }
 
+// HostStats are the counters of a host
+type HostStats struct {
+	Hits          uint64 // lookups answered from the cache
+	Misses        uint64 // lookups that had to wait for the forward resolver
+	Stale         uint64 // expired answers used after an error, see UseLastGood
+	Refreshes     uint64 // background lookups before the expiry
+	RefreshErrors uint64
+	LastError     error
+	LastErrorAt   time.Time
+	Expires       time.Time // zero when the host is not cached
+
+	lastSeen time.Time
+}
+
 func (r *Resolver) fwd() *net.Resolver {
 	if r.Forward != nil {
 		return r.Forward
@@ -78,149 +172,549 @@ func (r *Resolver) ttl() time.Duration {
 	return 10 * time.Minute
 }
 
+func (r *Resolver) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return time.Hour
+}
+
+func (r *Resolver) hotHits() int {
+	if r.HotHits > 0 {
+		return r.HotHits
+	}
+	return 2
+}
+
+func (r *Resolver) cleanupInterval() time.Duration {
+	if r.CleanupInterval > 0 {
+		return r.CleanupInterval
+	}
+	return time.Minute
+}
+
+func (r *Resolver) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// boundTTL applies MinTTL and MaxTTL to the TTL of a record
+func (r *Resolver) boundTTL(d time.Duration) time.Duration {
+	if r.MinTTL > 0 && d < r.MinTTL {
+		d = r.MinTTL
+	}
+	if r.MaxTTL > 0 && d > r.MaxTTL {
+		d = r.MaxTTL
+	}
+	return d
+}
+
 var debug, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DNS_CACHE"))
 
+// LookupIP returns the first IPv4 address of host, or its first IPv6 address if it has none.
+// v6 is the first IPv6 address when host has both.
 func (r *Resolver) LookupIP(ctx context.Context, host string) (ip, v6 net.IP, err error) {
+	ips, err := r.LookupIPs(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip, v6 = firstPair(ips)
+	return ip, v6, nil
+}
+
+// LookupIPs returns all addresses of host
+func (r *Resolver) LookupIPs(ctx context.Context, host string) ([]net.IP, error) {
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
-			return ip4, nil, nil
+			return []net.IP{ip4}, nil
 		}
 		if debug {
 			log.Printf("dnscache: %q is an IP", host)
 		}
-		return ip, nil, nil
+		return []net.IP{ip}, nil
 	}
 
-	if ip, ip6, ok := r.lookupIPCache(host); ok {
-		if debug {
-			log.Printf("dnscache: %q = %v (cached)", host, ip)
+	if r.Hosts != nil {
+		if ips, ok := r.Hosts.Lookup(host); ok {
+			if debug {
+				log.Printf("dnscache: %q = %v (hosts)", host, ips)
+			}
+			return ips, nil
 		}
-		return ip, ip6, nil
 	}
 
-	type ipPair struct {
-		ip, ip6 net.IP
+	if ips, ok := r.lookupIPCache(host); ok {
+		if debug {
+			log.Printf("dnscache: %q = %v (cached)", host, ips)
+		}
+		return ips, nil
 	}
+	if err := r.lookupNXCache(host); err != nil {
+		return r.lookupFailed(host, err)
+	}
+
+	r.countMiss(host)
 	ch := r.sf.DoChan(host, func() (interface{}, error) {
-		ip, ip6, err := r.lookupIP(host)
-		if err != nil {
-			return nil, err
-		}
-		return ipPair{ip, ip6}, nil
+		return r.lookupIP(host)
 	})
 
 	select {
 	case res := <-ch:
 		if res.Err != nil {
-			if r.UseLastGood {
-				if ip, ip6, ok := r.lookupIPCacheExpired(host); ok {
-					if debug {
-						log.Printf("dnscache: %q using %v after error", host, ip)
-					}
-					return ip, ip6, nil
-				}
-			}
-			if debug {
-				log.Printf("dnscache: error resolving %q: %v", host, res.Err)
-			}
-			return nil, nil, res.Err
+			return r.lookupFailed(host, res.Err)
 		}
-		pair := res.Val.(ipPair)
-		return pair.ip, pair.ip6, nil
+		return copyIPs(res.Val.([]net.IP)), nil
 
 	case <-ctx.Done():
 		if debug {
 			log.Printf("dnscache: context done while resolving %q: %v", host, ctx.Err())
 		}
-		return nil, nil, ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+// lookupFailed falls back to the last good answer if UseLastGood is set
+func (r *Resolver) lookupFailed(host string, err error) ([]net.IP, error) {
+	if r.UseLastGood {
+		if ips, ok := r.lookupIPCacheExpired(host); ok {
+			r.countStale(host)
+			if debug {
+				log.Printf("dnscache: %q using %v after error", host, ips)
+			}
+			return ips, nil
+		}
+	}
+	if debug {
+		log.Printf("dnscache: error resolving %q: %v", host, err)
 	}
+	return nil, err
 }
 
-func (r *Resolver) lookupIPCache(host string) (ip, ip6 net.IP, ok bool) {
+// Len returns the number of cached hosts
+func (r *Resolver) Len() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if ent, ok := r.ipCache[host]; ok && ent.expires.After(time.Now()) {
-		return ent.ip, ent.ip6, true
+	return len(r.ipCache)
+}
+
+// Cleanup drops the hosts idle for longer than IdleTimeout and, unless
+// UseLastGood is set, the expired ones. It refreshes the hot hosts that
+// would expire before the next run. The cleaner calls it periodically.
+func (r *Resolver) Cleanup() {
+	now := r.timeNow()
+	idle := r.idleTimeout()
+
+	var refresh []string
+	r.mu.Lock()
+	for _, ent := range r.ipCache {
+		if now.Sub(ent.lastUsed) > idle || (!r.UseLastGood && !now.Before(ent.expires)) {
+			if debug {
+				log.Printf("dnscache: dropping %q", ent.host)
+			}
+			r.removeLocked(ent)
+			continue
+		}
+		if r.shouldRefreshLocked(ent, now, r.cleanupInterval()) {
+			refresh = append(refresh, ent.host)
+		}
+	}
+	for host, ent := range r.nxCache {
+		if !now.Before(ent.expires) {
+			delete(r.nxCache, host)
+		}
+	}
+	for host, st := range r.stats {
+		if _, ok := r.ipCache[host]; !ok && now.Sub(st.lastSeen) > idle {
+			delete(r.stats, host)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, host := range refresh {
+		go r.refresh(host)
 	}
-	return nil, nil, false
 }
 
-func (r *Resolver) lookupIPCacheExpired(host string) (ip, ip6 net.IP, ok bool) {
+// Stats returns the counters of host
+func (r *Resolver) Stats(host string) (HostStats, bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	st, ok := r.stats[host]
+	if !ok {
+		return HostStats{}, false
+	}
+	return r.hostStatsLocked(host, st), true
+}
+
+// AllStats returns the counters of every host seen recently
+func (r *Resolver) AllStats() map[string]HostStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make(map[string]HostStats, len(r.stats))
+	for host, st := range r.stats {
+		all[host] = r.hostStatsLocked(host, st)
+	}
+	return all
+}
+
+func (r *Resolver) hostStatsLocked(host string, st *HostStats) HostStats {
+	stats := *st
 	if ent, ok := r.ipCache[host]; ok {
-		return ent.ip, ent.ip6, true
+		stats.Expires = ent.expires
 	}
-	return nil, nil, false
+	return stats
 }
 
-func (r *Resolver) lookupTimeoutForHost(host string) time.Duration {
-	if r.UseLastGood {
-		if _, _, ok := r.lookupIPCacheExpired(host); ok {
-			return 2 * time.Second
+// Close stops the background cleaner
+func (r *Resolver) Close() {
+	r.startOnce.Do(func() { r.stop = make(chan struct{}) })
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Resolver) start() {
+	r.startOnce.Do(func() {
+		r.stop = make(chan struct{})
+		go r.cleaner()
+	})
+}
+
+func (r *Resolver) cleaner() {
+	ticker := time.NewTicker(r.cleanupInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Cleanup()
+		case <-r.stop:
+			return
 		}
 	}
+}
+
+func (r *Resolver) lookupIPCache(host string) ([]net.IP, bool) {
+	r.mu.Lock()
+	now := r.timeNow()
+	ent, ok := r.ipCache[host]
+	if !ok || !ent.expires.After(now) {
+		r.mu.Unlock()
+		return nil, false
+	}
+
+	r.touchLocked(ent, now)
+	ent.hits++
+	r.statsLocked(host, now).Hits++
+	refresh := r.shouldRefreshLocked(ent, now, 0)
+	ips := copyIPs(ent.ips)
+	r.mu.Unlock()
+
+	if refresh {
+		go r.refresh(host)
+	}
+	return ips, true
+}
+
+// peekIPCache is lookupIPCache without counting the lookup
+func (r *Resolver) peekIPCache(host string) ([]net.IP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ent, ok := r.ipCache[host]; ok && ent.expires.After(r.timeNow()) {
+		return copyIPs(ent.ips), true
+	}
+	return nil, false
+}
+
+// shouldRefreshLocked reports whether the hot entry expires within RefreshBefore plus ahead,
+// it marks the entry as refreshing when so
+func (r *Resolver) shouldRefreshLocked(ent *ipCacheEntry, now time.Time, ahead time.Duration) bool {
+	if r.RefreshBefore <= 0 || ent.refreshing || ent.hits < r.hotHits() {
+		return false
+	}
+	if ent.expires.Sub(now) > r.RefreshBefore+ahead {
+		return false
+	}
+	ent.refreshing = true
+	return true
+}
+
+// refresh looks host up again in the background, sharing the lookup with concurrent misses
+func (r *Resolver) refresh(host string) {
+	_, err, _ := r.sf.Do(host, func() (interface{}, error) {
+		return r.resolve(host)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.statsLocked(host, r.timeNow())
+	st.Refreshes++
+	if err != nil {
+		st.RefreshErrors++
+	}
+	if ent, ok := r.ipCache[host]; ok {
+		ent.refreshing = false
+	}
+	if debug {
+		log.Printf("dnscache: refreshed %q: %v", host, err)
+	}
+}
+
+func (r *Resolver) statsLocked(host string, now time.Time) *HostStats {
+	if r.stats == nil {
+		r.stats = make(map[string]*HostStats)
+	}
+	st, ok := r.stats[host]
+	if !ok {
+		st = &HostStats{}
+		r.stats[host] = st
+	}
+	st.lastSeen = now
+	return st
+}
+
+func (r *Resolver) countMiss(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statsLocked(host, r.timeNow()).Misses++
+}
+
+func (r *Resolver) countStale(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statsLocked(host, r.timeNow()).Stale++
+}
+
+func (r *Resolver) countError(host string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.statsLocked(host, r.timeNow())
+	st.LastError = err
+	st.LastErrorAt = r.timeNow()
+}
+
+func (r *Resolver) lookupIPCacheExpired(host string) ([]net.IP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ent, ok := r.ipCache[host]; ok {
+		r.touchLocked(ent, r.timeNow())
+		return copyIPs(ent.ips), true
+	}
+	return nil, false
+}
+
+func (r *Resolver) hasIPCache(host string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ipCache[host]
+	return ok
+}
+
+// nextDial returns the round robin position of a cached host and advances it,
+// the position goes with the cache entry
+func (r *Resolver) nextDial(host string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ent, ok := r.ipCache[host]
+	if !ok {
+		return 0, false
+	}
+	n := ent.dials
+	ent.dials++
+	return n, true
+}
+
+func (r *Resolver) lookupTimeoutForHost(host string) time.Duration {
+	if r.UseLastGood && r.hasIPCache(host) {
+		return 2 * time.Second
+	}
 	return 10 * time.Second
 }
 
-func (r *Resolver) lookupIP(host string) (ip, ip6 net.IP, err error) {
-	if ip, ip6, ok := r.lookupIPCache(host); ok {
+func (r *Resolver) lookupIP(host string) ([]net.IP, error) {
+	if ips, ok := r.peekIPCache(host); ok {
 		if debug {
-			log.Printf("dnscache: %q found in cache as %v", host, ip)
+			log.Printf("dnscache: %q found in cache as %v", host, ips)
 		}
-		return ip, ip6, nil
+		return ips, nil
 	}
+	return r.resolve(host)
+}
 
+// resolve asks the forward resolver and caches the answer
+func (r *Resolver) resolve(host string) ([]net.IP, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), r.lookupTimeoutForHost(host))
 	defer cancel()
-	ips, err := r.fwd().LookupIPAddr(ctx, host)
-	if err != nil {
-		return nil, nil, err
+	addrs, err := r.lookupAddrs(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no IPs for %q found", host)
 	}
-	if len(ips) == 0 {
-		return nil, nil, fmt.Errorf("no IPs for %q found", host)
+	if err != nil {
+		r.countError(host, err)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			r.addNXCache(host, err)
+		}
+		return nil, err
 	}
 
-	have4 := false
-	for _, ipa := range ips {
-		if ip4 := ipa.IP.To4(); ip4 != nil {
-			if !have4 {
-				ip6 = ip
-				ip = ip4
-				have4 = true
-			}
-		} else {
-			if have4 {
-				ip6 = ipa.IP
-			} else {
-				ip = ipa.IP
-			}
+	ips := make([]net.IP, len(addrs))
+	ttl := r.boundTTL(addrs[0].TTL)
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+		if d := r.boundTTL(addr.TTL); d < ttl {
+			ttl = d
 		}
 	}
-	r.addIPCache(host, ip, ip6, r.ttl())
-	return ip, ip6, nil
+	r.addIPCache(host, ips, ttl)
+	return ips, nil
 }
 
-func (r *Resolver) addIPCache(host string, ip, ip6 net.IP, d time.Duration) {
-	if isPrivateIP(ip) {
-		// Don't cache obviously wrong entries from captive portals.
-		// TODO: use DoH or DoT for the forwarding resolver?
-		if debug {
-			log.Printf("dnscache: %q resolved to private IP %v; using but not caching", host, ip)
+func (r *Resolver) lookupAddrs(ctx context.Context, host string) ([]Addr, error) {
+	if r.Lookup != nil {
+		return r.Lookup(ctx, host)
+	}
+
+	ipas, err := r.fwd().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]Addr, len(ipas))
+	for i, ipa := range ipas {
+		ip := ipa.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
 		}
+		addrs[i] = Addr{IP: ip, TTL: r.ttl()}
+	}
+	return addrs, nil
+}
+
+// lookupNXCache returns the cached error of a host that does not exist, nil otherwise
+func (r *Resolver) lookupNXCache(host string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.timeNow()
+	if ent, ok := r.nxCache[host]; ok && ent.expires.After(now) {
+		r.statsLocked(host, now).Hits++
+		return ent.err
+	}
+	return nil
+}
+
+func (r *Resolver) addNXCache(host string, err error) {
+	if r.NegativeTTL <= 0 {
 		return
 	}
+	if debug {
+		log.Printf("dnscache: %q does not exist; caching for %v", host, r.NegativeTTL)
+	}
+
+	r.start()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nxCache == nil {
+		r.nxCache = make(map[string]nxCacheEntry)
+	}
+	r.nxCache[host] = nxCacheEntry{err: err, expires: r.timeNow().Add(r.NegativeTTL)}
+}
+
+// cacheable applies CacheCIDRs and NoCacheCIDRs to ip
+func (r *Resolver) cacheable(ip net.IP) bool {
+	for _, n := range r.CacheCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if r.NoCacheCIDRs == nil {
+		return !isPrivateIP(ip)
+	}
+	for _, n := range r.NoCacheCIDRs {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Resolver) addIPCache(host string, ips []net.IP, d time.Duration) {
+	for _, ip := range ips {
+		if !r.cacheable(ip) {
+			// Don't cache obviously wrong entries from captive portals.
+			// TODO: use DoH or DoT for the forwarding resolver?
+			if debug {
+				log.Printf("dnscache: %q resolved to IP %v outside of the cache policy; using but not caching", host, ip)
+			}
+			return
+		}
+	}
 
 	if debug {
-		log.Printf("dnscache: %q resolved to IP %v; caching", host, ip)
+		log.Printf("dnscache: %q resolved to IPs %v; caching for %v", host, ips, d)
 	}
 
+	r.start()
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.ipCache == nil {
-		r.ipCache = make(map[string]ipCacheEntry)
+		r.ipCache = make(map[string]*ipCacheEntry)
+	}
+	delete(r.nxCache, host)
+
+	now := r.timeNow()
+	ent, ok := r.ipCache[host]
+	if !ok {
+		ent = &ipCacheEntry{host: host}
+		ent.elem = r.lru.PushFront(ent)
+		r.ipCache[host] = ent
+	}
+	ent.ips = ips
+	ent.expires = now.Add(d)
+	ent.hits = 0
+	r.touchLocked(ent, now)
+
+	for r.MaxHosts > 0 && len(r.ipCache) > r.MaxHosts {
+		oldest := r.lru.Back().Value.(*ipCacheEntry)
+		if debug {
+			log.Printf("dnscache: evicting %q", oldest.host)
+		}
+		r.removeLocked(oldest)
 	}
-	r.ipCache[host] = ipCacheEntry{ip: ip, ip6: ip6, expires: time.Now().Add(d)}
+}
+
+func (r *Resolver) touchLocked(ent *ipCacheEntry, now time.Time) {
+	ent.lastUsed = now
+	r.lru.MoveToFront(ent.elem)
+}
+
+func (r *Resolver) removeLocked(ent *ipCacheEntry) {
+	delete(r.ipCache, ent.host)
+	r.lru.Remove(ent.elem)
+}
+
+// firstPair returns the first IPv4 address, or the first IPv6 one without IPv4,
+// and the first IPv6 address when there are both
+func firstPair(ips []net.IP) (ip, ip6 net.IP) {
+	for _, addr := range ips {
+		if ip4 := addr.To4(); ip4 != nil {
+			if ip == nil || ip.To4() == nil {
+				if ip != nil && ip6 == nil {
+					ip6 = ip
+				}
+				ip = ip4
+			}
+		} else if ip == nil {
+			ip = addr
+		} else if ip6 == nil && ip.To4() != nil {
+			ip6 = addr
+		}
+	}
+	return ip, ip6
+}
+
+func copyIPs(ips []net.IP) []net.IP {
+	return append([]net.IP(nil), ips...)
 }
 
 func mustCIDR(s string) *net.IPNet {
@@ -231,6 +725,19 @@ func mustCIDR(s string) *net.IPNet {
 	return ipNet
 }
 
+// ParseCIDRs parses networks for CacheCIDRs and NoCacheCIDRs
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
 func isPrivateIP(ip net.IP) bool {
 	return private1.Contains(ip) || private2.Contains(ip) || private3.Contains(ip)
 }
@@ -240,32 +747,3 @@ var (
 	private2 = mustCIDR("172.16.0.0/12")
 	private3 = mustCIDR("192.168.0.0/16")
 )
-
-type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
-
-// Dialer returns a wrapped DialContext func that uses the provided dnsCache.
-func Dialer(fwd DialContextFunc, dnsCache *Resolver) DialContextFunc {
-	return func(ctx context.Context, network, address string) (net.Conn, error) {
-		host, port, err := net.SplitHostPort(address)
-		if err != nil {
-			// Bogus. But just let the real dialer return an error rather than
-			// inventing a similar one.
-			return fwd(ctx, network, address)
-		}
-		ip, ip6, err := dnsCache.LookupIP(ctx, host)
-		if err != nil {
-			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
-		}
-		dst := net.JoinHostPort(ip.String(), port)
-		if debug {
-			log.Printf("dnscache: dialing %s, %s for %s", network, dst, address)
-		}
-		c, err := fwd(ctx, network, dst)
-		if err == nil || ctx.Err() != nil || ip6 == nil {
-			return c, err
-		}
-
-		dst = net.JoinHostPort(ip6.String(), port)
-		return fwd(ctx, network, dst)
-	}
-}
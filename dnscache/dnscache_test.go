@@ -1,8 +1,16 @@
 package dnscache
 
 import (
+	"context"
+	"errors"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestIsPrivateIP(t *testing.T) {
@@ -22,3 +30,418 @@ func TestIsPrivateIP(t *testing.T) {
 		}
 	}
 }
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeLookup answers from a table and counts the lookups per host
+type fakeLookup struct {
+	mu      sync.Mutex
+	answers map[string][]Addr
+	errs    map[string]error
+	calls   map[string]int
+}
+
+func newFakeLookup() *fakeLookup {
+	return &fakeLookup{
+		answers: make(map[string][]Addr),
+		errs:    make(map[string]error),
+		calls:   make(map[string]int),
+	}
+}
+
+func (f *fakeLookup) set(host string, addrs ...Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers[host] = addrs
+	delete(f.errs, host)
+}
+
+func (f *fakeLookup) fail(host string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[host] = err
+}
+
+func (f *fakeLookup) count(host string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[host]
+}
+
+func (f *fakeLookup) Lookup(ctx context.Context, host string) ([]Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[host]++
+	if err := f.errs[host]; err != nil {
+		return nil, err
+	}
+	if addrs, ok := f.answers[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func addr(ip string, ttl time.Duration) Addr {
+	parsed := net.ParseIP(ip)
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed = ip4
+	}
+	return Addr{IP: parsed, TTL: ttl}
+}
+
+func newTestResolver(f *fakeLookup) (*Resolver, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	r := &Resolver{Lookup: f.Lookup, now: clock.Now}
+	return r, clock
+}
+
+func TestLookupIPsTTL(t *testing.T) {
+	f := newFakeLookup()
+	f.set("example.com", addr("1.1.1.1", time.Minute), addr("1.1.1.2", 30*time.Second), addr("2001:db8::1", time.Hour))
+	r, clock := newTestResolver(f)
+	defer r.Close()
+	ctx := context.Background()
+
+	ips, err := r.LookupIPs(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 {
+		t.Fatalf("LookupIPs: %v, want all 3 addresses", ips)
+	}
+
+	ip, ip6, _ := r.LookupIP(ctx, "example.com")
+	if ip.String() != "1.1.1.1" || ip6.String() != "2001:db8::1" {
+		t.Fatalf("LookupIP: %v %v", ip, ip6)
+	}
+
+	clock.Advance(29 * time.Second)
+	r.LookupIPs(ctx, "example.com")
+	if n := f.count("example.com"); n != 1 {
+		t.Fatalf("lookups before the shortest ttl: %d, want 1", n)
+	}
+	clock.Advance(2 * time.Second)
+	r.LookupIPs(ctx, "example.com")
+	if n := f.count("example.com"); n != 2 {
+		t.Fatalf("lookups after the shortest ttl: %d, want 2", n)
+	}
+}
+
+func TestBoundTTL(t *testing.T) {
+	r := &Resolver{MinTTL: 10 * time.Second, MaxTTL: time.Minute}
+	for in, want := range map[time.Duration]time.Duration{
+		0:                0 + 10*time.Second,
+		30 * time.Second: 30 * time.Second,
+		time.Hour:        time.Minute,
+	} {
+		if got := r.boundTTL(in); got != want {
+			t.Errorf("boundTTL(%v)=%v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestMaxHosts(t *testing.T) {
+	f := newFakeLookup()
+	for _, host := range []string{"a", "b", "c"} {
+		f.set(host, addr("1.1.1.1", time.Hour))
+	}
+	r, _ := newTestResolver(f)
+	r.MaxHosts = 2
+	defer r.Close()
+	ctx := context.Background()
+
+	r.LookupIPs(ctx, "a")
+	r.LookupIPs(ctx, "b")
+	r.LookupIPs(ctx, "a")
+	r.LookupIPs(ctx, "c")
+	if r.Len() != 2 {
+		t.Fatalf("len: %d, want 2", r.Len())
+	}
+
+	// b was the least recently used
+	r.LookupIPs(ctx, "a")
+	r.LookupIPs(ctx, "b")
+	if f.count("a") != 1 || f.count("b") != 2 {
+		t.Fatalf("lookups: a %d, b %d, want 1 and 2", f.count("a"), f.count("b"))
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	f := newFakeLookup()
+	f.set("short", addr("1.1.1.1", time.Minute))
+	f.set("long", addr("1.1.1.2", 24*time.Hour))
+	r, clock := newTestResolver(f)
+	defer r.Close()
+	ctx := context.Background()
+
+	r.LookupIPs(ctx, "short")
+	r.LookupIPs(ctx, "long")
+	clock.Advance(2 * time.Minute)
+	r.Cleanup()
+	if r.Len() != 1 {
+		t.Fatalf("len after expiry: %d, want 1", r.Len())
+	}
+
+	clock.Advance(2 * time.Hour)
+	r.Cleanup()
+	if r.Len() != 0 {
+		t.Fatalf("len after idle timeout: %d, want 0", r.Len())
+	}
+}
+
+func TestUseLastGood(t *testing.T) {
+	f := newFakeLookup()
+	f.set("example.com", addr("1.1.1.1", time.Minute))
+	r, clock := newTestResolver(f)
+	r.UseLastGood = true
+	defer r.Close()
+	ctx := context.Background()
+
+	r.LookupIPs(ctx, "example.com")
+	clock.Advance(2 * time.Minute)
+	r.Cleanup()
+	f.fail("example.com", errors.New("timeout"))
+
+	ips, err := r.LookupIPs(ctx, "example.com")
+	if err != nil || len(ips) != 1 || ips[0].String() != "1.1.1.1" {
+		t.Fatalf("LookupIPs: %v %v, want the last good address", ips, err)
+	}
+}
+
+// serveDNS runs a dns server on a local udp port answering with handler
+func serveDNS(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestDNSLookup(t *testing.T) {
+	server := serveDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name != "example.com.":
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer,
+				&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30}, Target: "lb.example.com."},
+				&dns.A{Hdr: dns.RR_Header{Name: "lb.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("1.1.1.1")},
+				&dns.A{Hdr: dns.RR_Header{Name: "lb.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("1.1.1.2")},
+			)
+		case q.Qtype == dns.TypeAAAA:
+			m.Answer = append(m.Answer,
+				&dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 600}, AAAA: net.ParseIP("2001:db8::1")},
+			)
+		}
+		w.WriteMsg(m)
+	})
+
+	lookup := DNSLookup(server)
+	addrs, err := lookup(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1.1.1.1 30s", "1.1.1.2 30s", "2001:db8::1 10m0s"}
+	if len(addrs) != len(want) {
+		t.Fatalf("addrs: %v, want %v", addrs, want)
+	}
+	for i, a := range addrs {
+		if got := a.IP.String() + " " + a.TTL.String(); got != want[i] {
+			t.Errorf("addr %d: %s, want %s", i, got, want[i])
+		}
+	}
+
+	_, err = lookup(context.Background(), "missing.example.com")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Fatalf("missing host: %v, want a not found error", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRefreshBeforeExpiry(t *testing.T) {
+	f := newFakeLookup()
+	f.set("example.com", addr("1.1.1.1", time.Minute))
+	r, clock := newTestResolver(f)
+	r.RefreshBefore = 10 * time.Second
+	defer r.Close()
+	ctx := context.Background()
+
+	r.LookupIPs(ctx, "example.com")
+	clock.Advance(20 * time.Second)
+	r.LookupIPs(ctx, "example.com")
+	clock.Advance(35 * time.Second)
+	if f.count("example.com") != 1 {
+		t.Fatal("refreshed before the host was hot")
+	}
+
+	// the second hit within 10s of the expiry makes the host hot
+	f.set("example.com", addr("1.1.1.2", time.Minute))
+	r.LookupIPs(ctx, "example.com")
+	waitFor(t, func() bool {
+		st, _ := r.Stats("example.com")
+		return st.Refreshes == 1
+	})
+
+	clock.Advance(10 * time.Second)
+	ips, _ := r.LookupIPs(ctx, "example.com")
+	if len(ips) != 1 || ips[0].String() != "1.1.1.2" {
+		t.Fatalf("LookupIPs after the old expiry: %v, want the refreshed address", ips)
+	}
+
+	st, ok := r.Stats("example.com")
+	if !ok || st.Hits != 3 || st.Misses != 1 || st.Refreshes != 1 || st.RefreshErrors != 0 {
+		t.Fatalf("stats: %+v", st)
+	}
+	if f.count("example.com") != 2 {
+		t.Fatalf("lookups: %d, want 2", f.count("example.com"))
+	}
+}
+
+func TestRefreshError(t *testing.T) {
+	f := newFakeLookup()
+	f.set("example.com", addr("1.1.1.1", time.Minute))
+	r, clock := newTestResolver(f)
+	r.RefreshBefore = 10 * time.Second
+	r.HotHits = 1
+	defer r.Close()
+	ctx := context.Background()
+
+	r.LookupIPs(ctx, "example.com")
+	f.fail("example.com", errors.New("servfail"))
+	clock.Advance(55 * time.Second)
+	r.LookupIPs(ctx, "example.com")
+	waitFor(t, func() bool {
+		st, _ := r.Stats("example.com")
+		return st.RefreshErrors == 1
+	})
+
+	st, _ := r.Stats("example.com")
+	if st.LastError == nil || st.LastError.Error() != "servfail" || st.Expires.IsZero() {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	f := newFakeLookup()
+	f.set("internal", addr("10.1.2.3", time.Hour))
+	f.set("public", addr("1.2.3.4", time.Hour))
+	ctx := context.Background()
+
+	r, _ := newTestResolver(f)
+	defer r.Close()
+	r.LookupIPs(ctx, "internal")
+	r.LookupIPs(ctx, "public")
+	if r.Len() != 1 {
+		t.Fatalf("len with the default policy: %d, want 1", r.Len())
+	}
+
+	r2, _ := newTestResolver(f)
+	defer r2.Close()
+	r2.CacheCIDRs, _ = ParseCIDRs("10.0.0.0/8")
+	r2.NoCacheCIDRs, _ = ParseCIDRs("1.2.3.0/24")
+	r2.LookupIPs(ctx, "internal")
+	r2.LookupIPs(ctx, "public")
+	if _, ok := r2.peekIPCache("internal"); !ok || r2.Len() != 1 {
+		t.Fatalf("len with the datacenter policy: %d, want only internal", r2.Len())
+	}
+
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Fatal("invalid cidr was parsed")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte("# static\n10.0.0.1 db db.internal  # primary\n10.0.0.2 db\n::1 localhost6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadHostsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeLookup()
+	r, _ := newTestResolver(f)
+	r.Hosts = hosts
+	defer r.Close()
+
+	ips, err := r.LookupIPs(context.Background(), "DB.internal.")
+	if err != nil || len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Fatalf("LookupIPs: %v %v", ips, err)
+	}
+	if ips, _ := r.LookupIPs(context.Background(), "db"); len(ips) != 2 {
+		t.Fatalf("LookupIPs(db): %v, want 2 addresses", ips)
+	}
+
+	os.WriteFile(path, []byte("10.0.0.3 db\n"), 0644)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	if err := hosts.ReloadFile(); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := r.LookupIPs(context.Background(), "db"); len(ips) != 1 || ips[0].String() != "10.0.0.3" {
+		t.Fatalf("LookupIPs after reload: %v", ips)
+	}
+	if _, ok := hosts.Lookup("db.internal"); ok {
+		t.Fatal("removed host still resolves")
+	}
+	if f.count("db") != 0 {
+		t.Fatal("static host was looked up")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	f := newFakeLookup()
+	r, clock := newTestResolver(f)
+	r.NegativeTTL = time.Minute
+	defer r.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupIPs(ctx, "missing")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatalf("LookupIPs: %v, want not found", err)
+		}
+	}
+	if f.count("missing") != 1 {
+		t.Fatalf("lookups: %d, want 1", f.count("missing"))
+	}
+
+	f.set("missing", addr("1.1.1.1", time.Minute))
+	clock.Advance(time.Minute)
+	if ips, err := r.LookupIPs(ctx, "missing"); err != nil || len(ips) != 1 {
+		t.Fatalf("LookupIPs after the negative ttl: %v %v", ips, err)
+	}
+}
@@ -0,0 +1,153 @@
+package dnscache
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts is a static table of host names to addresses in the format of /etc/hosts,
+// a Resolver answers from it before looking anything up.
+type Hosts struct {
+	mu      sync.RWMutex
+	table   map[string][]net.IP
+	path    string
+	modTime time.Time
+}
+
+func NewHosts() *Hosts {
+	return &Hosts{table: make(map[string][]net.IP)}
+}
+
+// LoadHostsFile returns the table of the hosts file at path, see ReloadFile and Watch
+func LoadHostsFile(path string) (*Hosts, error) {
+	h := NewHosts()
+	h.path = path
+	if err := h.ReloadFile(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Lookup returns the addresses of host
+func (h *Hosts) Lookup(host string) ([]net.IP, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ips, ok := h.table[canonicalHost(host)]
+	return copyIPs(ips), ok
+}
+
+// Set makes host resolve to ips
+func (h *Hosts) Set(host string, ips ...net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.table[canonicalHost(host)] = copyIPs(ips)
+}
+
+func (h *Hosts) Del(host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.table, canonicalHost(host))
+}
+
+// Load replaces the table with the hosts file read from r.
+// Every line is an address followed by its names, # starts a comment.
+func (h *Hosts) Load(r io.Reader) error {
+	table := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, name := range fields[1:] {
+			name = canonicalHost(name)
+			table[name] = append(table[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.table = table
+	return nil
+}
+
+// ReloadFile loads the file the table came from again if it changed since
+func (h *Hosts) ReloadFile() error {
+	if h.path == "" {
+		return nil
+	}
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h.mu.RLock()
+	unchanged := fi.ModTime().Equal(h.modTime)
+	h.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	if err := h.Load(f); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.modTime = fi.ModTime()
+	h.mu.Unlock()
+	if debug {
+		log.Printf("dnscache: loaded hosts file %s", h.path)
+	}
+	return nil
+}
+
+// Watch reloads the file the table came from every interval until the returned func is called
+func (h *Hosts) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := h.ReloadFile(); err != nil && debug {
+					log.Printf("dnscache: reloading hosts file %s: %v", h.path, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// canonicalHost lowercases host and drops the trailing dot of a fully qualified name
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
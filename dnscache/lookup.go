@@ -0,0 +1,104 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSLookup returns a LookupFunc asking the servers directly for the A and AAAA
+// records of a host, so the cache knows their TTLs. The servers are tried in
+// order, a port of 53 is assumed when none is given.
+func DNSLookup(servers ...string) LookupFunc {
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		addrs[i] = server
+	}
+	return func(ctx context.Context, host string) ([]Addr, error) {
+		type result struct {
+			addrs []Addr
+			err   error
+		}
+		v4, v6 := make(chan result, 1), make(chan result, 1)
+		for qtype, ch := range map[uint16]chan result{dns.TypeA: v4, dns.TypeAAAA: v6} {
+			go func(qtype uint16, ch chan result) {
+				addrs, err := queryAddrs(ctx, addrs, host, qtype)
+				ch <- result{addrs, err}
+			}(qtype, ch)
+		}
+
+		r4, r6 := <-v4, <-v6
+		if r4.err != nil && (r6.err != nil || len(r6.addrs) == 0) {
+			return nil, r4.err
+		}
+		if r6.err != nil && len(r4.addrs) == 0 {
+			return nil, r6.err
+		}
+		return append(r4.addrs, r6.addrs...), nil
+	}
+}
+
+func queryAddrs(ctx context.Context, servers []string, host string, qtype uint16) ([]Addr, error) {
+	// a dns.Client is not safe for concurrent exchanges with a context
+	client := &dns.Client{}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	m.RecursionDesired = true
+
+	var err error
+	for _, server := range servers {
+		var in *dns.Msg
+		in, _, err = client.ExchangeContext(ctx, m, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch in.Rcode {
+		case dns.RcodeSuccess:
+			return answerAddrs(in), nil
+		case dns.RcodeNameError:
+			return nil, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		default:
+			err = &net.DNSError{Err: dns.RcodeToString[in.Rcode], Name: host, Server: server}
+		}
+	}
+	return nil, err
+}
+
+// answerAddrs collects the addresses of an answer, a CNAME chain lives only as long as its shortest TTL
+func answerAddrs(in *dns.Msg) []Addr {
+	chain := ^uint32(0)
+	for _, rr := range in.Answer {
+		if c, ok := rr.(*dns.CNAME); ok && c.Hdr.Ttl < chain {
+			chain = c.Hdr.Ttl
+		}
+	}
+
+	var addrs []Addr
+	for _, rr := range in.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A.To4()
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		ttl := rr.Header().Ttl
+		if chain < ttl {
+			ttl = chain
+		}
+		addrs = append(addrs, Addr{IP: ip, TTL: time.Duration(ttl) * time.Second})
+	}
+	return addrs
+}
@@ -1,85 +1,133 @@
 package dnsquery
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
-	"math/rand"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	DefaultTimeout = 5 * time.Second
+
+	// DefaultUDPSize is the EDNS0 payload size that avoids IP fragmentation, see dnsflagday.net/2020
+	DefaultUDPSize = 1232
+)
+
 type DnsResolver struct {
-	Servers    []string
+	Servers []string
+	// RetryTimes is how often a query is sent at most over all servers, default once per server
 	RetryTimes int
 
-	r *rand.Rand
+	// Timeout bounds every try, the deadline of the context bounds the whole query, default 5s
+	Timeout time.Duration
+	// Rotate spreads the queries round robin over the servers, otherwise the first server is asked first
+	Rotate bool
+	// UDPSize is the EDNS0 payload size advertised over UDP, 0 disables EDNS0
+	UDPSize uint16
+
+	// Ndots and Search expand relative names like the options of resolv.conf
+	Ndots  int
+	Search []string
+
+	// TLSConfig is used by tls:// and https:// servers, nil verifies them with the system roots
+	TLSConfig *tls.Config
+	// DoHGet sends DNS-over-HTTPS queries with GET, which HTTP caches can store, instead of POST
+	DoHGet bool
+
+	next       uint32
+	mu         sync.Mutex
+	transports map[string]transport
 }
 
+// New returns a resolver for servers, which are addresses with port 53 by default
+// or URLs like tls://1.1.1.1 and https://dns.example/dns-query
 func New(servers []string) *DnsResolver {
 	for i := range servers {
-		servers[i] = net.JoinHostPort(servers[i], "53")
+		if !strings.Contains(servers[i], "://") {
+			servers[i] = net.JoinHostPort(servers[i], "53")
+		}
 	}
 
-	return &DnsResolver{servers, len(servers) * 2, rand.New(rand.NewSource(time.Now().UnixNano()))}
+	return &DnsResolver{
+		Servers:    servers,
+		RetryTimes: len(servers) * 2,
+		Rotate:     true,
+		UDPSize:    DefaultUDPSize,
+		Ndots:      1,
+	}
 }
 
+// NewFromResolvConf returns a resolver with the nameservers, search domains and
+// the timeout, attempts, rotate and ndots options of the resolv.conf at path
 func NewFromResolvConf(path string) (*DnsResolver, error) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
 		return &DnsResolver{}, errors.New("no such file or directory: " + path)
 	}
+	if err != nil {
+		return &DnsResolver{}, err
+	}
 
-	config, err := dns.ClientConfigFromFile(path)
+	config, err := dns.ClientConfigFromReader(bytes.NewReader(data))
+	if err != nil {
+		return &DnsResolver{}, err
+	}
 	servers := []string{}
 	for _, ipAddress := range config.Servers {
-		servers = append(servers, net.JoinHostPort(ipAddress, "53"))
+		servers = append(servers, net.JoinHostPort(ipAddress, config.Port))
 	}
 
-	return &DnsResolver{servers, len(servers) * 2, rand.New(rand.NewSource(time.Now().UnixNano()))}, err
+	return &DnsResolver{
+		Servers:    servers,
+		RetryTimes: len(servers) * config.Attempts,
+		Timeout:    time.Duration(config.Timeout) * time.Second,
+		Rotate:     hasRotate(data),
+		UDPSize:    DefaultUDPSize,
+		Ndots:      config.Ndots,
+		Search:     config.Search,
+	}, nil
 }
 
-func (r *DnsResolver) LookupHost(host string) ([]net.IP, error) {
-	var (
-		res []net.IP
-		err error
-	)
-
-	for r.RetryTimes > 0 {
-		res, err = r.lookupHost(host)
-		if err == nil {
-			return res, err
+// hasRotate reports whether resolv.conf sets options rotate, miekg/dns ignores it
+func hasRotate(data []byte) bool {
+	rotate := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || f[0] != "options" {
+			continue
+		}
+		for _, opt := range f[1:] {
+			if opt == "rotate" {
+				rotate = true
+			}
 		}
-
-		r.RetryTimes--
 	}
+	return rotate
+}
 
-	return res, err
+func (r *DnsResolver) LookupHost(host string) ([]net.IP, error) {
+	return r.lookupHost(host)
 }
 
 func (r *DnsResolver) lookupHost(host string) ([]net.IP, error) {
-	m := new(dns.Msg)
-	m.Id = dns.Id()
-	m.RecursionDesired = true
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
-
-	// query
-	in, err := dns.Exchange(m, r.Servers[r.r.Intn(len(r.Servers))])
-
-	result := []net.IP{}
+	answer, err := r.LookupA(context.Background(), host)
 	if err != nil {
-		return result, err
+		return []net.IP{}, err
 	}
 
-	if in != nil && in.Rcode != dns.RcodeSuccess {
-		return result, errors.New(dns.RcodeToString[in.Rcode])
+	result := answer.Values()
+	if result == nil {
+		result = []net.IP{}
 	}
-
-	for _, record := range in.Answer {
-		if t, ok := record.(*dns.A); ok {
-			result = append(result, t.A)
-		}
-	}
-
-	return result, err
+	return result, nil
 }
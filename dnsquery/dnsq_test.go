@@ -1,9 +1,15 @@
 package dnsquery
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -59,3 +65,133 @@ func TestLookupHost_ValidServer(t *testing.T) {
 		t.Fatal("not query")
 	}
 }
+
+func TestNewFromResolvConf_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "nameserver 10.0.0.1\nnameserver 10.0.0.2\nsearch a.example b.example\noptions timeout:2 attempts:3 rotate ndots:2\n"
+	if err := os.WriteFile(path, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewFromResolvConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Timeout != 2*time.Second || r.RetryTimes != 6 || !r.Rotate || r.Ndots != 2 {
+		t.Fatalf("options: %+v", r)
+	}
+	if !reflect.DeepEqual(r.Search, []string{"a.example", "b.example"}) {
+		t.Fatalf("search: %v", r.Search)
+	}
+}
+
+func TestRetryFailover(t *testing.T) {
+	var failed int32
+	bad := serveDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&failed, 1)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	good := serveZone(t, testZone)
+
+	r := newTestResolver(bad, good)
+	r.RetryTimes = 2
+	for i := 0; i < 5; i++ {
+		ips, err := r.LookupHost("lb.example.org")
+		if err != nil || len(ips) != 2 {
+			t.Fatalf("LookupHost %d: %v, %v", i, ips, err)
+		}
+	}
+	// failures do not use up the retries of later queries
+	if r.RetryTimes != 2 || atomic.LoadInt32(&failed) != 5 {
+		t.Fatalf("retry times: %d, failed: %d", r.RetryTimes, failed)
+	}
+
+	r.Rotate = true
+	for i := 0; i < 4; i++ {
+		answer, err := r.LookupA(context.Background(), "lb.example.org")
+		if err != nil || answer.Server != good {
+			t.Fatalf("LookupA %d: %+v, %v", i, answer, err)
+		}
+	}
+	if atomic.LoadInt32(&failed) != 7 {
+		t.Fatalf("failed: %d, want the bad server asked every other query", failed)
+	}
+
+	r.RetryTimes = 1
+	r.Servers = []string{bad}
+	if _, err := r.LookupHost("lb.example.org"); err == nil || err.Error() != "SERVFAIL" {
+		t.Fatalf("LookupHost: %v, want SERVFAIL", err)
+	}
+}
+
+func TestTruncatedRetriesOverTCP(t *testing.T) {
+	var udpSize uint32
+	addr := serveDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		if opt := req.IsEdns0(); opt != nil {
+			atomic.StoreUint32(&udpSize, uint32(opt.UDPSize()))
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR("big.example.org. 60 IN A 192.0.2.9")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+
+	r := newTestResolver(addr)
+	r.UDPSize = 4096
+	ips, err := r.LookupHost("big.example.org")
+	if err != nil || len(ips) != 1 {
+		t.Fatalf("LookupHost: %v, %v", ips, err)
+	}
+	if size := atomic.LoadUint32(&udpSize); size != 4096 {
+		t.Fatalf("edns0 udp size: %d, want 4096", size)
+	}
+}
+
+func TestQueryContextTimeout(t *testing.T) {
+	// a server that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	r := newTestResolver(pc.LocalAddr().String())
+	r.Timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = r.LookupA(ctx, "example.org")
+	if err == nil {
+		t.Fatal("LookupA succeeded without an answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("LookupA took %v, want it bounded by the context", elapsed)
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+	r.Ndots = 1
+	r.Search = []string{"missing.example", "example.org"}
+
+	answer, err := r.LookupA(context.Background(), "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 2 || answer.Records[0].Name != "lb.example.org." {
+		t.Fatalf("records: %+v", answer.Records)
+	}
+
+	// names with enough dots are tried as they are first
+	if _, err := r.LookupA(context.Background(), "lb.example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
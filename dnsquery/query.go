@@ -0,0 +1,403 @@
+package dnsquery
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const maxCNAMEChain = 8
+
+var (
+	ErrNoServers    = errors.New("dnsquery: no servers")
+	ErrCNAMELoop    = errors.New("dnsquery: cname chain too long")
+	ErrInvalidReply = errors.New("dnsquery: reply does not match the question")
+)
+
+// RcodeError is returned for replies that are not successful, e.g. NXDOMAIN
+type RcodeError struct {
+	Rcode  int
+	Name   string
+	Server string
+}
+
+func (e *RcodeError) Error() string {
+	return dns.RcodeToString[e.Rcode]
+}
+
+// IsNotFound reports whether err tells that the name does not exist
+func IsNotFound(err error) bool {
+	var rerr *RcodeError
+	return errors.As(err, &rerr) && rerr.Rcode == dns.RcodeNameError
+}
+
+// Record is a typed answer record
+type Record[T any] struct {
+	Name  string
+	TTL   time.Duration
+	Value T
+}
+
+// Answer holds the typed records of a lookup and the server that answered
+type Answer[T any] struct {
+	Server  string
+	Records []Record[T]
+}
+
+// Values returns the values of the records
+func (a *Answer[T]) Values() []T {
+	values := make([]T, len(a.Records))
+	for i, rec := range a.Records {
+		values[i] = rec.Value
+	}
+	return values
+}
+
+// MinTTL returns the shortest TTL of the records, 0 without records
+func (a *Answer[T]) MinTTL() time.Duration {
+	var ttl time.Duration
+	for i, rec := range a.Records {
+		if i == 0 || rec.TTL < ttl {
+			ttl = rec.TTL
+		}
+	}
+	return ttl
+}
+
+type SRV struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+type MX struct {
+	Host string
+	Pref uint16
+}
+
+// Query asks for the records of type qtype of name, the records of the answer section are returned
+func (r *DnsResolver) Query(ctx context.Context, name string, qtype uint16) (*Answer[dns.RR], error) {
+	in, server, err := r.exchange(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := &Answer[dns.RR]{Server: server}
+	for _, rr := range in.Answer {
+		answer.Records = append(answer.Records, record(rr, rr))
+	}
+	return answer, nil
+}
+
+// LookupA returns the IPv4 addresses of host, following CNAMEs
+func (r *DnsResolver) LookupA(ctx context.Context, host string) (*Answer[net.IP], error) {
+	return lookup(ctx, r, host, dns.TypeA, func(rr dns.RR) (net.IP, bool) {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			return nil, false
+		}
+		return a.A, true
+	})
+}
+
+// LookupAAAA returns the IPv6 addresses of host, following CNAMEs
+func (r *DnsResolver) LookupAAAA(ctx context.Context, host string) (*Answer[net.IP], error) {
+	return lookup(ctx, r, host, dns.TypeAAAA, func(rr dns.RR) (net.IP, bool) {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			return nil, false
+		}
+		return aaaa.AAAA, true
+	})
+}
+
+// LookupCNAME follows the CNAME chain of host, there is a record per hop and
+// the value of the last one is the canonical name. A host without CNAME has no records.
+func (r *DnsResolver) LookupCNAME(ctx context.Context, host string) (*Answer[string], error) {
+	answer := &Answer[string]{}
+	name := host
+	for {
+		in, server, err := r.exchange(ctx, name, dns.TypeCNAME)
+		if err != nil {
+			return nil, err
+		}
+		answer.Server = server
+		name = in.Question[0].Name
+
+		target, hops := followCNAME(in.Answer, name)
+		answer.Records = append(answer.Records, hops...)
+		if len(answer.Records) > maxCNAMEChain {
+			return nil, ErrCNAMELoop
+		}
+		if len(hops) == 0 {
+			return answer, nil
+		}
+		name = target
+	}
+}
+
+// LookupSRV returns the SRV records of _service._proto.name sorted by priority and randomized by weight,
+// with an empty service and proto name is queried directly
+func (r *DnsResolver) LookupSRV(ctx context.Context, service, proto, name string) (*Answer[SRV], error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+	answer, err := lookup(ctx, r, name, dns.TypeSRV, func(rr dns.RR) (SRV, bool) {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			return SRV{}, false
+		}
+		return SRV{Target: srv.Target, Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight}, true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSRV(answer.Records, rand.Intn)
+	return answer, nil
+}
+
+// sortSRV orders the records by priority and those of a priority in the weighted random
+// order of RFC 2782, so every target gets the share of the traffic its weight asks for
+func sortSRV(records []Record[SRV], intn func(n int) int) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Value.Priority < records[j].Value.Priority
+	})
+
+	for i := 0; i < len(records); {
+		j := i + 1
+		for j < len(records) && records[j].Value.Priority == records[i].Value.Priority {
+			j++
+		}
+		shuffleByWeight(records[i:j], intn)
+		i = j
+	}
+}
+
+// shuffleByWeight picks every position with a chance proportional to the weight of the
+// records left, like net.LookupSRV does
+func shuffleByWeight(records []Record[SRV], intn func(n int) int) {
+	sum := 0
+	for _, rec := range records {
+		sum += int(rec.Value.Weight)
+	}
+	for sum > 0 && len(records) > 1 {
+		s, n := 0, intn(sum)
+		for i := range records {
+			s += int(records[i].Value.Weight)
+			if s > n {
+				records[0], records[i] = records[i], records[0]
+				break
+			}
+		}
+		sum -= int(records[0].Value.Weight)
+		records = records[1:]
+	}
+}
+
+// LookupTXT returns the TXT records of name, the strings of a record are joined
+func (r *DnsResolver) LookupTXT(ctx context.Context, name string) (*Answer[string], error) {
+	return lookup(ctx, r, name, dns.TypeTXT, func(rr dns.RR) (string, bool) {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			return "", false
+		}
+		return strings.Join(txt.Txt, ""), true
+	})
+}
+
+// LookupMX returns the MX records of name sorted by preference
+func (r *DnsResolver) LookupMX(ctx context.Context, name string) (*Answer[MX], error) {
+	answer, err := lookup(ctx, r, name, dns.TypeMX, func(rr dns.RR) (MX, bool) {
+		mx, ok := rr.(*dns.MX)
+		if !ok {
+			return MX{}, false
+		}
+		return MX{Host: mx.Mx, Pref: mx.Preference}, true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(answer.Records, func(i, j int) bool {
+		return answer.Records[i].Value.Pref < answer.Records[j].Value.Pref
+	})
+	return answer, nil
+}
+
+// LookupPTR returns the names of the address addr
+func (r *DnsResolver) LookupPTR(ctx context.Context, addr string) (*Answer[string], error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return lookup(ctx, r, arpa, dns.TypePTR, func(rr dns.RR) (string, bool) {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			return "", false
+		}
+		return ptr.Ptr, true
+	})
+}
+
+// lookup queries name for qtype and converts the records of the answer with value.
+// CNAMEs are followed within the answer and, when the server did not, with further queries.
+func lookup[T any](ctx context.Context, r *DnsResolver, name string, qtype uint16, value func(dns.RR) (T, bool)) (*Answer[T], error) {
+	answer := &Answer[T]{}
+
+	// the chain caps the TTL of the records it leads to
+	var chain []Record[string]
+	for {
+		in, server, err := r.exchange(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		answer.Server = server
+		name = in.Question[0].Name
+
+		target, hops := followCNAME(in.Answer, name)
+		chain = append(chain, hops...)
+		if len(chain) > maxCNAMEChain {
+			return nil, ErrCNAMELoop
+		}
+		chainTTL := (&Answer[string]{Records: chain}).MinTTL()
+
+		for _, rr := range in.Answer {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if v, ok := value(rr); ok {
+				rec := record(rr, v)
+				if len(chain) > 0 && chainTTL < rec.TTL {
+					rec.TTL = chainTTL
+				}
+				answer.Records = append(answer.Records, rec)
+			}
+		}
+		if len(answer.Records) > 0 || len(hops) == 0 {
+			return answer, nil
+		}
+		name = target
+	}
+}
+
+// followCNAME walks the CNAMEs of rrs starting at name and returns the final target and the hops
+func followCNAME(rrs []dns.RR, name string) (string, []Record[string]) {
+	var hops []Record[string]
+	for i := 0; i <= maxCNAMEChain; i++ {
+		next := ""
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				hops = append(hops, record(rr, cname.Target))
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name, hops
+}
+
+func record[T any](rr dns.RR, value T) Record[T] {
+	hdr := rr.Header()
+	return Record[T]{
+		Name:  hdr.Name,
+		TTL:   time.Duration(hdr.Ttl) * time.Second,
+		Value: value,
+	}
+}
+
+// exchange queries the names the search domains expand name to until one of them exists
+func (r *DnsResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	if len(r.Servers) == 0 {
+		return nil, "", ErrNoServers
+	}
+
+	var (
+		in     *dns.Msg
+		server string
+		err    error
+	)
+	names := (&dns.ClientConfig{Ndots: r.Ndots, Search: r.Search}).NameList(name)
+	for _, fqdn := range names {
+		in, server, err = r.query(ctx, fqdn, qtype)
+		if !IsNotFound(err) {
+			break
+		}
+	}
+	return in, server, err
+}
+
+// query sends the question to the servers in turn until one answers, at most RetryTimes times
+func (r *DnsResolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	if r.UDPSize > 0 {
+		m.SetEdns0(r.UDPSize, false)
+	}
+
+	tries := r.RetryTimes
+	if tries <= 0 {
+		tries = len(r.Servers)
+	}
+	start := 0
+	if r.Rotate {
+		start = int((atomic.AddUint32(&r.next, 1) - 1) % uint32(len(r.Servers)))
+	}
+
+	var (
+		server string
+		err    error
+	)
+	for i := 0; i < tries; i++ {
+		server = r.Servers[(start+i)%len(r.Servers)]
+		var in *dns.Msg
+		in, err = r.try(ctx, m, server)
+		if err == nil {
+			return in, server, nil
+		}
+		// a name that does not exist does not exist on the other servers either
+		if ctx.Err() != nil || IsNotFound(err) {
+			break
+		}
+	}
+	return nil, server, err
+}
+
+// try sends m to server over its transport within the timeout and checks the reply
+func (r *DnsResolver) try(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	t, err := r.transport(server)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	in, err := t.exchange(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Question) != 1 || !strings.EqualFold(in.Question[0].Name, m.Question[0].Name) {
+		return nil, ErrInvalidReply
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, &RcodeError{Rcode: in.Rcode, Name: m.Question[0].Name, Server: server}
+	}
+	return in, nil
+}
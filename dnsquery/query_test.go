@@ -0,0 +1,262 @@
+package dnsquery
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testZone = map[uint16][]string{
+	dns.TypeA: {
+		"www.example.org. 300 IN CNAME web.example.org.",
+		"web.example.org. 60 IN CNAME lb.example.org.",
+		"lb.example.org. 600 IN A 192.0.2.1",
+		"lb.example.org. 600 IN A 192.0.2.2",
+	},
+	dns.TypeAAAA: {
+		"lb.example.org. 120 IN AAAA 2001:db8::1",
+	},
+	dns.TypeSRV: {
+		"_sip._tcp.example.org. 60 IN SRV 20 0 5060 sip2.example.org.",
+		"_sip._tcp.example.org. 60 IN SRV 10 5 5060 sip1.example.org.",
+		"_sip._tcp.example.org. 60 IN SRV 10 50 5061 sip3.example.org.",
+	},
+	dns.TypeTXT: {
+		`example.org. 60 IN TXT "v=spf1 " "-all"`,
+	},
+	dns.TypeMX: {
+		"example.org. 60 IN MX 20 mx2.example.org.",
+		"example.org. 60 IN MX 10 mx1.example.org.",
+	},
+	dns.TypePTR: {
+		"1.2.0.192.in-addr.arpa. 60 IN PTR lb.example.org.",
+	},
+}
+
+// serveZone answers from zone, a query for a name without records is NXDOMAIN.
+// Only the first hop of a CNAME chain is returned to make the resolver follow it.
+func serveZone(t *testing.T, zone map[uint16][]string) string {
+	var rrs []dns.RR
+	for _, records := range zone {
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return serveDNS(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		found := false
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Name != q.Name {
+				continue
+			}
+			found = true
+			if hdr.Rrtype == q.Qtype || hdr.Rrtype == dns.TypeCNAME {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+}
+
+// serveDNS runs handler over UDP and TCP on the same local port
+func serveDNS(t *testing.T, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	for _, server := range []*dns.Server{{PacketConn: pc}, {Listener: ln}} {
+		server := server
+		started := make(chan struct{})
+		server.Handler = handler
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func newTestResolver(servers ...string) *DnsResolver {
+	return &DnsResolver{
+		Servers: servers,
+		Timeout: time.Second,
+		UDPSize: DefaultUDPSize,
+	}
+}
+
+func TestLookupA(t *testing.T) {
+	addr := serveZone(t, testZone)
+	r := newTestResolver(addr)
+
+	answer, err := r.LookupA(context.Background(), "www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Server != addr {
+		t.Errorf("server: %s, want %s", answer.Server, addr)
+	}
+	want := []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()}
+	if got := answer.Values(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ips: %v, want %v", got, want)
+	}
+	// the chain is followed over three queries, its shortest TTL caps the records
+	if ttl := answer.MinTTL(); ttl != time.Minute {
+		t.Errorf("ttl: %v, want 1m", ttl)
+	}
+
+	ips, err := r.LookupHost("lb.example.org")
+	if err != nil || len(ips) != 2 {
+		t.Errorf("LookupHost: %v, %v", ips, err)
+	}
+}
+
+func TestLookupAAAA(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+
+	answer, err := r.LookupAAAA(context.Background(), "lb.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 1 || !answer.Records[0].Value.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("records: %+v", answer.Records)
+	}
+	if answer.Records[0].TTL != 2*time.Minute {
+		t.Errorf("ttl: %v, want 2m", answer.Records[0].TTL)
+	}
+}
+
+func TestLookupCNAME(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+
+	answer, err := r.LookupCNAME(context.Background(), "www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"web.example.org.", "lb.example.org."}
+	if got := answer.Values(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("chain: %v, want %v", got, want)
+	}
+
+	answer, err = r.LookupCNAME(context.Background(), "lb.example.org")
+	if err != nil || len(answer.Records) != 0 {
+		t.Fatalf("canonical name: %+v, %v", answer, err)
+	}
+}
+
+func TestLookupCNAMELoop(t *testing.T) {
+	r := newTestResolver(serveZone(t, map[uint16][]string{
+		dns.TypeA: {
+			"a.example.org. 60 IN CNAME b.example.org.",
+			"b.example.org. 60 IN CNAME a.example.org.",
+		},
+	}))
+
+	if _, err := r.LookupA(context.Background(), "a.example.org"); err != ErrCNAMELoop {
+		t.Fatalf("LookupA: %v, want %v", err, ErrCNAMELoop)
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+
+	answer, err := r.LookupSRV(context.Background(), "sip", "tcp", "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := answer.Values()
+	sip1 := SRV{Target: "sip1.example.org.", Port: 5060, Priority: 10, Weight: 5}
+	sip3 := SRV{Target: "sip3.example.org.", Port: 5061, Priority: 10, Weight: 50}
+	sip2 := SRV{Target: "sip2.example.org.", Port: 5060, Priority: 20, Weight: 0}
+	if len(got) != 3 || got[2] != sip2 || !(got[0] == sip3 && got[1] == sip1 || got[0] == sip1 && got[1] == sip3) {
+		t.Fatalf("srv: %+v", got)
+	}
+}
+
+func TestSortSRVByWeight(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	first := map[string]int{}
+	const runs = 10000
+	for i := 0; i < runs; i++ {
+		records := []Record[SRV]{
+			{Value: SRV{Target: "backup", Priority: 20, Weight: 100}},
+			{Value: SRV{Target: "heavy", Priority: 10, Weight: 60}},
+			{Value: SRV{Target: "light", Priority: 10, Weight: 30}},
+			{Value: SRV{Target: "lighter", Priority: 10, Weight: 10}},
+		}
+		sortSRV(records, rnd.Intn)
+		if records[3].Value.Target != "backup" {
+			t.Fatalf("lower priority sorted before: %+v", records)
+		}
+		first[records[0].Value.Target]++
+	}
+
+	// every target comes first about as often as its weight asks for
+	for target, weight := range map[string]float64{"heavy": 0.6, "light": 0.3, "lighter": 0.1} {
+		if share := float64(first[target]) / runs; share < weight-0.03 || share > weight+0.03 {
+			t.Fatalf("%s first in %.3f of the runs, want about %.1f", target, share, weight)
+		}
+	}
+}
+
+func TestLookupTXTMXPTR(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+	ctx := context.Background()
+
+	txt, err := r.LookupTXT(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(txt.Values(), []string{"v=spf1 -all"}) {
+		t.Fatalf("LookupTXT: %+v, %v", txt, err)
+	}
+
+	mx, err := r.LookupMX(ctx, "example.org")
+	want := []MX{{Host: "mx1.example.org.", Pref: 10}, {Host: "mx2.example.org.", Pref: 20}}
+	if err != nil || !reflect.DeepEqual(mx.Values(), want) {
+		t.Fatalf("LookupMX: %+v, %v", mx, err)
+	}
+
+	ptr, err := r.LookupPTR(ctx, "192.0.2.1")
+	if err != nil || !reflect.DeepEqual(ptr.Values(), []string{"lb.example.org."}) {
+		t.Fatalf("LookupPTR: %+v, %v", ptr, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	r := newTestResolver(serveZone(t, testZone))
+
+	answer, err := r.Query(context.Background(), "example.org", dns.TypeMX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer.Records) != 2 {
+		t.Fatalf("records: %+v", answer.Records)
+	}
+	if _, ok := answer.Records[0].Value.(*dns.MX); !ok {
+		t.Errorf("record: %T, want *dns.MX", answer.Records[0].Value)
+	}
+
+	_, err = r.Query(context.Background(), "missing.example.org", dns.TypeA)
+	if !IsNotFound(err) || err.Error() != "NXDOMAIN" {
+		t.Fatalf("Query: %v, want NXDOMAIN", err)
+	}
+}
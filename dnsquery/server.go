@@ -0,0 +1,382 @@
+package dnsquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultZoneTTL is the TTL of zone records that do not set one
+const DefaultZoneTTL = 300
+
+var ErrServerStarted = errors.New("dnsquery: server already started")
+
+// Zone is a static set of records the Server answers authoritatively
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+	names  map[string][]dns.RR
+}
+
+// NewZone returns the zone of origin with records by owner name, the names are
+// relative to origin unless they end with a dot, "@" is origin itself:
+//
+//	NewZone("example.org", map[string][]string{
+//		"www":       {"A 192.0.2.1", "60 AAAA 2001:db8::1"},
+//		"_sip._tcp": {"SRV 10 5 5060 sip"},
+//	})
+func NewZone(origin string, records map[string][]string) (*Zone, error) {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// records without TTL do not inherit the one of the previous record
+	var b strings.Builder
+	fmt.Fprintf(&b, "$TTL %d\n", DefaultZoneTTL)
+	for _, name := range names {
+		for _, rr := range records[name] {
+			fmt.Fprintf(&b, "%s %s\n", name, rr)
+		}
+	}
+	return ParseZone(origin, strings.NewReader(b.String()))
+}
+
+// ParseZone reads the zone of origin in the zone file format of RFC 1035
+func ParseZone(origin string, r io.Reader) (*Zone, error) {
+	origin = dns.CanonicalName(origin)
+	z := &Zone{origin: origin, names: make(map[string][]dns.RR)}
+
+	zp := dns.NewZoneParser(r, origin, "")
+	zp.SetDefaultTTL(DefaultZoneTTL)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := z.add(rr); err != nil {
+			return nil, err
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: DefaultZoneTTL},
+			Ns:      "ns." + origin,
+			Mbox:    "hostmaster." + origin,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  DefaultZoneTTL,
+		}
+	}
+	return z, nil
+}
+
+// LoadZoneFile reads the zone of origin from the zone file at path
+func LoadZoneFile(origin, path string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(origin, f)
+}
+
+func (z *Zone) add(rr dns.RR) error {
+	name := dns.CanonicalName(rr.Header().Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("dnsquery: %s is out of zone %s", name, z.origin)
+	}
+	rr.Header().Name = name
+	if soa, ok := rr.(*dns.SOA); ok && name == z.origin {
+		z.soa = soa
+	}
+	z.names[name] = append(z.names[name], rr)
+	return nil
+}
+
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// hasBelow reports whether name is an empty non-terminal, a name without records of its own
+// but with records below it, which exists and is answered with NODATA
+func (z *Zone) hasBelow(name string) bool {
+	for owner := range z.names {
+		if owner != name && dns.IsSubDomain(name, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// answer fills m with the records of q, following CNAMEs within the zone
+func (z *Zone) answer(m *dns.Msg, q dns.Question) {
+	name := dns.CanonicalName(q.Name)
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		rrs, ok := z.names[name]
+		if !ok {
+			if hops == 0 && !z.hasBelow(name) {
+				m.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+				m.Answer = append(m.Answer, rr)
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if cname == nil {
+			break
+		}
+		m.Answer = append(m.Answer, cname)
+		if !dns.IsSubDomain(z.origin, dns.CanonicalName(cname.Target)) {
+			break
+		}
+		name = dns.CanonicalName(cname.Target)
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, z.soa)
+		return
+	}
+
+	// the addresses of SRV and MX targets in the zone save the client a query
+	for _, rr := range m.Answer {
+		var target string
+		switch v := rr.(type) {
+		case *dns.SRV:
+			target = v.Target
+		case *dns.MX:
+			target = v.Mx
+		default:
+			continue
+		}
+		for _, extra := range z.names[dns.CanonicalName(target)] {
+			if t := extra.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				m.Extra = append(m.Extra, extra)
+			}
+		}
+	}
+}
+
+// Server answers the names of its zones authoritatively and forwards the rest
+// to the upstream resolver, which makes it a split-horizon override or a stand-in
+// for real servers in tests.
+type Server struct {
+	upstream *DnsResolver
+
+	mu      sync.RWMutex
+	zones   map[string]*Zone
+	servers []*dns.Server
+	done    chan struct{}
+}
+
+// NewServer returns a server for zones, names outside of them are refused without upstream
+func NewServer(upstream *DnsResolver, zones ...*Zone) *Server {
+	s := &Server{upstream: upstream, zones: make(map[string]*Zone)}
+	for _, z := range zones {
+		s.AddZone(z)
+	}
+	return s
+}
+
+// AddZone serves z, it replaces the zone of the same origin
+func (s *Server) AddZone(z *Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[z.origin] = z
+}
+
+func (s *Server) RemoveZone(origin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, dns.CanonicalName(origin))
+}
+
+// zone returns the most specific zone of name
+func (s *Server) zone(name string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best *Zone
+	for origin, z := range s.zones {
+		if dns.IsSubDomain(origin, name) && (best == nil || len(origin) > len(best.origin)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// ServeDNS implements dns.Handler
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Compress = true
+
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+
+	q := req.Question[0]
+	if z := s.zone(dns.CanonicalName(q.Name)); z != nil {
+		m.Authoritative = true
+		z.answer(m, q)
+	} else {
+		s.forward(m, q)
+	}
+
+	// a UDP reply must fit the buffer of the client
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+			m.SetEdns0(opt.UDPSize(), false)
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+func (s *Server) forward(m *dns.Msg, q dns.Question) {
+	if s.upstream == nil {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.RecursionAvailable = true
+
+	answer, err := s.upstream.Query(context.Background(), q.Name, q.Qtype)
+	var rerr *RcodeError
+	switch {
+	case errors.As(err, &rerr):
+		m.Rcode = rerr.Rcode
+	case err != nil:
+		m.Rcode = dns.RcodeServerFailure
+	default:
+		m.Answer = answer.Values()
+	}
+}
+
+// Start serves UDP and TCP on addr, an address with port 0 picks a free port,
+// and returns the address it listens on
+func (s *Server) Start(addr string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers != nil {
+		return "", ErrServerStarted
+	}
+
+	pc, ln, err := listen(addr)
+	if err != nil {
+		return "", err
+	}
+
+	servers := []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: ln, Handler: s}}
+	if err := activate(servers); err != nil {
+		pc.Close()
+		ln.Close()
+		return "", err
+	}
+
+	s.servers = servers
+	s.done = make(chan struct{})
+	return pc.LocalAddr().String(), nil
+}
+
+// listenAttempts bounds how often a free port is picked again when its tcp side is taken
+const listenAttempts = 10
+
+// listen binds udp and tcp to the same port, with port 0 the udp port picked may be
+// in use for tcp and another one is tried
+func listen(addr string) (net.PacketConn, net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		ln, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, ln, nil
+		}
+		pc.Close()
+		if port != "0" || attempt == listenAttempts {
+			return nil, nil, err
+		}
+	}
+}
+
+// activate starts serving on servers one after the other, when one fails to start
+// the ones started before are shut down
+func activate(servers []*dns.Server) error {
+	for i, server := range servers {
+		started := make(chan struct{})
+		failed := make(chan error, 1)
+		server.NotifyStartedFunc = func() { close(started) }
+		go func(server *dns.Server) {
+			failed <- server.ActivateAndServe()
+		}(server)
+
+		select {
+		case <-started:
+		case err := <-failed:
+			for _, server := range servers[:i] {
+				server.Shutdown()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenAndServe serves on addr until Shutdown
+func (s *Server) ListenAndServe(addr string) error {
+	if _, err := s.Start(addr); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	done := s.done
+	s.mu.RUnlock()
+	<-done
+	return nil
+}
+
+func (s *Server) Shutdown() error {
+	// the lock is not held while shutting down, it waits for handlers that need it
+	s.mu.Lock()
+	servers, done := s.servers, s.done
+	s.servers, s.done = nil, nil
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, server := range servers {
+		if err := server.Shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if done != nil {
+		close(done)
+	}
+	return firstErr
+}
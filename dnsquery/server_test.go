@@ -0,0 +1,231 @@
+package dnsquery
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown() })
+	return addr
+}
+
+func exchange(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	in, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestServerZone(t *testing.T) {
+	zone, err := NewZone("corp.example", map[string][]string{
+		"@":         {"NS ns1"},
+		"api":       {"60 A 10.0.0.1", "60 A 10.0.0.2"},
+		"www":       {"CNAME api"},
+		"sip1":      {"A 10.0.1.1"},
+		"_sip._tcp": {"30 SRV 10 5 5060 sip1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startServer(t, NewServer(nil, zone))
+
+	in := exchange(t, addr, "api.corp.example", dns.TypeA)
+	if !in.Authoritative || in.Rcode != dns.RcodeSuccess || len(in.Answer) != 2 {
+		t.Fatalf("api: %v", in)
+	}
+	if ttl := in.Answer[0].Header().Ttl; ttl != 60 {
+		t.Fatalf("ttl: %d, want 60", ttl)
+	}
+
+	// the CNAME is chased within the zone
+	in = exchange(t, addr, "WWW.corp.example", dns.TypeA)
+	if len(in.Answer) != 3 || in.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("www: %v", in)
+	}
+	if ttl := in.Answer[0].Header().Ttl; ttl != DefaultZoneTTL {
+		t.Fatalf("default ttl: %d, want %d", ttl, DefaultZoneTTL)
+	}
+
+	in = exchange(t, addr, "_sip._tcp.corp.example", dns.TypeSRV)
+	if len(in.Answer) != 1 || len(in.Extra) != 1 || in.Extra[0].(*dns.A).A.String() != "10.0.1.1" {
+		t.Fatalf("srv: %v", in)
+	}
+
+	// missing names and types are negative answers with the SOA
+	in = exchange(t, addr, "missing.corp.example", dns.TypeA)
+	if in.Rcode != dns.RcodeNameError || len(in.Ns) != 1 || in.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("missing: %v", in)
+	}
+	in = exchange(t, addr, "api.corp.example", dns.TypeTXT)
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 || len(in.Ns) != 1 {
+		t.Fatalf("nodata: %v", in)
+	}
+	// a name with records only below it exists
+	in = exchange(t, addr, "_tcp.corp.example", dns.TypeSRV)
+	if in.Rcode != dns.RcodeSuccess || len(in.Answer) != 0 || len(in.Ns) != 1 || in.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("empty non-terminal: %v", in)
+	}
+
+	// without upstream everything else is refused
+	in = exchange(t, addr, "example.org", dns.TypeA)
+	if in.Rcode != dns.RcodeRefused {
+		t.Fatalf("outside: %v", in)
+	}
+}
+
+func TestServerForward(t *testing.T) {
+	upstream := newTestResolver(serveZone(t, testZone))
+	override, err := NewZone("lb.example.org", map[string][]string{
+		"@": {"A 127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(upstream, override)
+	r := newTestResolver(startServer(t, s))
+
+	// the override hides the upstream records
+	ips, err := r.LookupHost("lb.example.org")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("override: %v, %v", ips, err)
+	}
+
+	mx, err := r.LookupMX(context.Background(), "example.org")
+	if err != nil || len(mx.Records) != 2 {
+		t.Fatalf("forwarded: %+v, %v", mx, err)
+	}
+	if _, err := r.LookupA(context.Background(), "missing.example.org"); !IsNotFound(err) {
+		t.Fatalf("forwarded NXDOMAIN: %v", err)
+	}
+
+	s.RemoveZone("lb.example.org")
+	ips, err = r.LookupHost("lb.example.org")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("removed override: %v, %v", ips, err)
+	}
+}
+
+func TestLoadZoneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corp.zone")
+	data := `$TTL 120
+@	IN SOA ns1 hostmaster 2024010101 3600 600 86400 60
+	IN NS ns1
+ns1	IN A 10.0.0.53
+db	30 IN A 10.0.0.10 ; primary
+	30 IN TXT "role=primary"
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zone, err := LoadZoneFile("corp.example.", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Origin() != "corp.example." || zone.soa.Serial != 2024010101 {
+		t.Fatalf("zone: %s, soa %v", zone.Origin(), zone.soa)
+	}
+
+	r := newTestResolver(startServer(t, NewServer(nil, zone)))
+	txt, err := r.LookupTXT(context.Background(), "db.corp.example")
+	if err != nil || !reflect.DeepEqual(txt.Values(), []string{"role=primary"}) || txt.MinTTL() != 30*time.Second {
+		t.Fatalf("txt: %+v, %v", txt, err)
+	}
+	a, err := r.LookupA(context.Background(), "ns1.corp.example")
+	if err != nil || a.MinTTL() != 2*time.Minute {
+		t.Fatalf("a: %+v, %v", a, err)
+	}
+
+	if _, err := NewZone("corp.example", map[string][]string{"www.other.example.": {"A 10.0.0.1"}}); err == nil {
+		t.Fatal("NewZone accepted an out of zone record")
+	}
+}
+
+func TestServerShutdownUnderLoad(t *testing.T) {
+	z, _ := NewZone("example.org", map[string][]string{"www": {"A 192.0.2.1"}})
+	s := NewServer(nil, z)
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		go func() {
+			c := &dns.Client{Net: "tcp", Timeout: 100 * time.Millisecond}
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", dns.TypeA)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.Exchange(m, addr)
+				}
+			}
+		}()
+	}
+	defer close(stop)
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked with queries in flight")
+	}
+}
+
+func TestServerStartFreePorts(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := NewServer(nil)
+		if _, err := s.Start("127.0.0.1:0"); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		defer s.Shutdown()
+	}
+}
+
+func TestServerActivateFails(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+
+	// the tcp server started first is shut down again
+	tcp := &dns.Server{Listener: ln, Handler: NewServer(nil)}
+	done := make(chan error, 1)
+	go func() { done <- activate([]*dns.Server{tcp, {PacketConn: pc}}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("activate on a closed conn succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("activate blocked on a server that failed to start")
+	}
+	if err := tcp.Shutdown(); err == nil {
+		t.Fatal("the started server was not shut down")
+	}
+}
@@ -0,0 +1,314 @@
+package dnsquery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	dotIdleConns = 4
+)
+
+var ErrUnsupportedServer = errors.New("dnsquery: unsupported server scheme")
+
+// transport carries a query to a single server
+type transport interface {
+	exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	close()
+}
+
+// transport returns the transport of server, which is selected by its scheme:
+//
+//	1.1.1.1:53 or udp://1.1.1.1   UDP, TCP when the reply is truncated
+//	tcp://1.1.1.1                 TCP
+//	tls://1.1.1.1                 DNS-over-TLS, RFC 7858, port 853 by default
+//	https://dns.example/dns-query DNS-over-HTTPS, RFC 8484
+//
+// The transports of tls and https servers keep their connections for the next queries.
+func (r *DnsResolver) transport(server string) (transport, error) {
+	scheme, addr := "udp", server
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme, addr = server[:i], server[i+3:]
+	}
+
+	switch scheme {
+	case "udp", "tcp":
+		return &plainTransport{addr: withPort(addr, "53"), tcp: scheme == "tcp", udpSize: r.UDPSize}, nil
+	case "tls", "https":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedServer, server)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.transports[server]; ok {
+		return t, nil
+	}
+
+	var t transport
+	if scheme == "tls" {
+		t = &dotTransport{addr: withPort(addr, "853"), config: r.TLSConfig, idle: make(chan *dns.Conn, dotIdleConns)}
+	} else {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		t = newDoHTransport(u, r.TLSConfig, r.DoHGet)
+	}
+	if r.transports == nil {
+		r.transports = make(map[string]transport)
+	}
+	r.transports[server] = t
+	return t, nil
+}
+
+// Close closes the connections kept to tls and https servers
+func (r *DnsResolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for server, t := range r.transports {
+		t.close()
+		delete(r.transports, server)
+	}
+	return nil
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+type plainTransport struct {
+	addr    string
+	tcp     bool
+	udpSize uint16
+}
+
+func (t *plainTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if t.tcp {
+		return t.send(ctx, m, "tcp")
+	}
+	in, err := t.send(ctx, m, "udp")
+	if err == nil && in.Truncated {
+		in, err = t.send(ctx, m, "tcp")
+	}
+	return in, err
+}
+
+// send exchanges m within the deadline of ctx, the miekg client does not
+// watch the context so the exchange is raced against it
+func (t *plainTransport) send(ctx context.Context, m *dns.Msg, network string) (*dns.Msg, error) {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	type result struct {
+		in  *dns.Msg
+		err error
+	}
+	done := make(chan result, 1)
+	client := &dns.Client{Net: network, UDPSize: t.udpSize, Timeout: timeout}
+	m = m.Copy()
+	go func() {
+		in, _, err := client.Exchange(m, t.addr)
+		done <- result{in, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.in, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *plainTransport) close() {}
+
+// dotTransport sends one query at a time over a TLS connection and keeps a few idle ones
+type dotTransport struct {
+	addr   string
+	config *tls.Config
+	idle   chan *dns.Conn
+}
+
+func (t *dotTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	var conn *dns.Conn
+	select {
+	case conn = <-t.idle:
+		in, reusable, err := roundTrip(ctx, conn, m)
+		if err == nil {
+			t.put(conn, reusable)
+			return in, nil
+		}
+		// the server may have closed the idle connection meanwhile
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	default:
+	}
+
+	dialer := &tls.Dialer{Config: t.config}
+	c, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn = &dns.Conn{Conn: c}
+	in, reusable, err := roundTrip(ctx, conn, m)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.put(conn, reusable)
+	return in, nil
+}
+
+func (t *dotTransport) put(conn *dns.Conn, reusable bool) {
+	if !reusable {
+		conn.Close()
+		return
+	}
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (t *dotTransport) close() {
+	for {
+		select {
+		case conn := <-t.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// roundTrip writes m to conn and reads the reply, the connection is not reusable
+// when the context was done meanwhile since its deadline was cut short
+func roundTrip(ctx context.Context, conn *dns.Conn, m *dns.Msg) (*dns.Msg, bool, error) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	in, err := func() (*dns.Msg, error) {
+		if err := conn.WriteMsg(m); err != nil {
+			return nil, err
+		}
+		in, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if in.Id != m.Id {
+			return nil, dns.ErrId
+		}
+		return in, nil
+	}()
+	reusable := stop()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return in, reusable, err
+}
+
+// dohTransport posts queries in wire format, or gets them with DoHGet, over HTTP/2
+type dohTransport struct {
+	url    *url.URL
+	get    bool
+	client *http.Client
+}
+
+func newDoHTransport(u *url.URL, config *tls.Config, get bool) *dohTransport {
+	return &dohTransport{
+		url: u,
+		get: get,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     config.Clone(),
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: dotIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+}
+
+func (t *dohTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// the id is 0 so that caches see the same request for the same question
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if t.get {
+		u := *t.url
+		query := u.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(buf))
+		u.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url.String(), bytes.NewReader(buf))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("dnsquery: %s answered %s", t.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("dnsquery: %s answered content type %q", t.url, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, err
+	}
+	in.Id = m.Id
+	return in, nil
+}
+
+func (t *dohTransport) close() {
+	t.client.CloseIdleConnections()
+}
@@ -0,0 +1,167 @@
+package dnsquery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerA replies to every question with 192.0.2.53
+func answerA(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.53")
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+// testCert returns the certificate of httptest, valid for 127.0.0.1 and example.com
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv.TLS.Certificates[0], pool
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+func TestDoT(t *testing.T) {
+	cert, pool := testCert(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingListener{Listener: ln}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:               "tcp-tls",
+		Listener:          tls.NewListener(counting, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			w.WriteMsg(answerA(req))
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+
+	r := newTestResolver("tls://" + ln.Addr().String())
+	r.TLSConfig = &tls.Config{RootCAs: pool}
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		ips, err := r.LookupHost("example.org")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.53")) {
+			t.Fatalf("LookupHost %d: %v, %v", i, ips, err)
+		}
+	}
+	if n := atomic.LoadInt32(&counting.accepted); n != 1 {
+		t.Fatalf("connections: %d, want 1", n)
+	}
+
+	// a certificate that does not verify fails
+	r = newTestResolver("tls://" + ln.Addr().String())
+	defer r.Close()
+	if _, err := r.LookupHost("example.org"); err == nil {
+		t.Fatal("LookupHost trusted an unknown certificate")
+	}
+}
+
+func TestDoH(t *testing.T) {
+	var (
+		conns   int32
+		methods = make(chan string, 10)
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "want HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		var buf []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = io.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err != nil || req.Unpack(buf) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if req.Id != 0 {
+			http.Error(w, "id is not 0", http.StatusBadRequest)
+			return
+		}
+		methods <- r.Method
+
+		out, _ := answerA(req).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	r := newTestResolver(srv.URL + "/dns-query")
+	r.TLSConfig = &tls.Config{RootCAs: pool}
+	defer r.Close()
+
+	for _, get := range []bool{false, true} {
+		r.DoHGet = get
+		r.Close()
+		for i := 0; i < 2; i++ {
+			answer, err := r.LookupA(context.Background(), "example.org")
+			if err != nil || len(answer.Records) != 1 || answer.Server != srv.URL+"/dns-query" {
+				t.Fatalf("LookupA get=%v: %+v, %v", get, answer, err)
+			}
+		}
+	}
+	if got := []string{<-methods, <-methods, <-methods, <-methods}; got[0] != "POST" || got[3] != "GET" {
+		t.Fatalf("methods: %v", got)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Fatalf("connections: %d, want one per transport", n)
+	}
+
+	r = newTestResolver("quic://" + srv.Listener.Addr().String())
+	if _, err := r.LookupHost("example.org"); !errors.Is(err, ErrUnsupportedServer) {
+		t.Fatalf("LookupHost: %v, want %v", err, ErrUnsupportedServer)
+	}
+}
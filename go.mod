@@ -1,27 +1,36 @@
 module github.com/rfyiamcool/golib
 
-go 1.14
+go 1.24
 
 require (
 	github.com/davecgh/go-spew v1.1.1
-	github.com/fastly/go-utils v0.0.0-20180712184237-d95a45783239 // indirect
 	github.com/fatih/color v1.9.0
-	github.com/google/go-cmp v0.5.2 // indirect
-	github.com/jehiah/go-strftime v0.0.0-20171201141054-1d33003b3869 // indirect
 	github.com/jimlawless/whereami v0.0.0-20160417220522-aebf70d4a772
-	github.com/jonboulle/clockwork v0.2.0 // indirect
 	github.com/karlseguin/ccache/v2 v2.0.6
 	github.com/lestrrat-go/file-rotatelogs v2.3.0+incompatible
-	github.com/lestrrat-go/strftime v1.0.3 // indirect
 	github.com/miekg/dns v1.1.31
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/mitchellh/hashstructure v1.1.0
 	github.com/rifflock/lfshook v0.0.0-20180920164130-b9218ef580f5
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1
-	github.com/tebeka/strftime v0.1.5 // indirect
-	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/automaxprocs v1.3.0
-	go.uber.org/ratelimit v0.1.0
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 	gotest.tools v2.2.0+incompatible
 )
+
+require (
+	github.com/fastly/go-utils v0.0.0-20180712184237-d95a45783239 // indirect
+	github.com/google/go-cmp v0.5.2 // indirect
+	github.com/jehiah/go-strftime v0.0.0-20171201141054-1d33003b3869 // indirect
+	github.com/jonboulle/clockwork v0.2.0 // indirect
+	github.com/lestrrat-go/strftime v1.0.3 // indirect
+	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mattn/go-isatty v0.0.11 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/tebeka/strftime v0.1.5 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
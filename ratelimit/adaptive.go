@@ -0,0 +1,487 @@
+package ratelimiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrOverloaded is returned when a call is refused because the concurrency limit is reached
+	ErrOverloaded = errors.New("ratelimit: concurrency limit reached")
+)
+
+// Sample is what an Algorithm learns from a finished call
+type Sample struct {
+	RTT      time.Duration
+	InFlight int  // calls in flight when the call started, including itself
+	Dropped  bool // the call failed for load reasons, e.g. timed out
+}
+
+// Algorithm adjusts a concurrency limit from the samples of finished calls, it is not safe for concurrent use
+type Algorithm interface {
+	Limit() int
+	Update(s Sample) int
+}
+
+// AIMD grows the limit by one while it is used and multiplies it with backoff on drops, like tcp Reno
+type AIMD struct {
+	limit, min, max int
+	backoff         float64
+}
+
+// NewAIMD returns an AIMD starting at initial and staying within [min, max], backoff is 0.9
+func NewAIMD(initial, min, max int) *AIMD {
+	return &AIMD{limit: initial, min: min, max: max, backoff: 0.9}
+}
+
+func (a *AIMD) Limit() int {
+	return a.limit
+}
+
+func (a *AIMD) Update(s Sample) int {
+	switch {
+	case s.Dropped:
+		a.limit = clampInt(int(float64(a.limit)*a.backoff), a.min, a.max)
+	case s.InFlight*2 >= a.limit:
+		a.limit = clampInt(a.limit+1, a.min, a.max)
+	}
+	return a.limit
+}
+
+// Vegas estimates the queue from the rtt against the rtt without load, like tcp Vegas.
+// It grows the limit while the queue is short and shrinks it once the queue builds up.
+type Vegas struct {
+	limit, max int
+	rttNoLoad  time.Duration
+	probe      int // samples until rttNoLoad is measured again
+}
+
+func NewVegas(initial, max int) *Vegas {
+	return &Vegas{limit: initial, max: max}
+}
+
+func (v *Vegas) Limit() int {
+	return v.limit
+}
+
+func (v *Vegas) Update(s Sample) int {
+	if v.probe--; v.probe <= 0 {
+		// the base rtt may have moved, e.g. after a deploy
+		v.probe = 30 * v.limit
+		v.rttNoLoad = 0
+	}
+	if s.RTT <= 0 {
+		return v.limit
+	}
+	if v.rttNoLoad == 0 || s.RTT < v.rttNoLoad {
+		v.rttNoLoad = s.RTT
+		return v.limit
+	}
+
+	log := math.Max(1, math.Log10(float64(v.limit)))
+	limit := float64(v.limit)
+	switch {
+	case s.Dropped:
+		limit -= log
+	case s.InFlight*2 < v.limit:
+		// not enough load to learn anything
+		return v.limit
+	default:
+		queue := math.Ceil(limit * (1 - float64(v.rttNoLoad)/float64(s.RTT)))
+		alpha, beta := 3*log, 6*log
+		switch {
+		case queue <= log:
+			limit += beta
+		case queue < alpha:
+			limit += log
+		case queue > beta:
+			limit -= log
+		}
+	}
+
+	v.limit = clampInt(int(limit), 1, v.max)
+	return v.limit
+}
+
+// Gradient2 follows the gradient of a long term average rtt against the current rtt.
+// It tolerates rtts up to 1.5 times the long term average before it shrinks the limit.
+type Gradient2 struct {
+	estimate  float64
+	min, max  int
+	longRTT   float64 // exponential average over about 600 samples
+	samples   int
+	tolerance float64
+	smoothing float64
+}
+
+func NewGradient2(initial, min, max int) *Gradient2 {
+	return &Gradient2{
+		estimate:  float64(initial),
+		min:       min,
+		max:       max,
+		tolerance: 1.5,
+		smoothing: 0.2,
+	}
+}
+
+func (g *Gradient2) Limit() int {
+	return int(g.estimate)
+}
+
+func (g *Gradient2) Update(s Sample) int {
+	rtt := float64(s.RTT)
+	if rtt <= 0 {
+		return g.Limit()
+	}
+
+	g.samples++
+	if g.samples <= 10 {
+		// warm up with a plain average
+		g.longRTT += (rtt - g.longRTT) / float64(g.samples)
+	} else {
+		g.longRTT += (rtt - g.longRTT) * 2 / 601
+	}
+	if g.longRTT/rtt > 2 {
+		// the long term average lags behind a recovery, let it decay faster
+		g.longRTT *= 0.95
+	}
+
+	if s.InFlight*2 < int(g.estimate) && !s.Dropped {
+		return g.Limit()
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.tolerance*g.longRTT/rtt))
+	if s.Dropped {
+		gradient = 0.5
+	}
+	queue := math.Sqrt(g.estimate)
+	limit := g.estimate*gradient + queue
+	limit = g.estimate*(1-g.smoothing) + limit*g.smoothing
+	g.estimate = math.Max(float64(g.min), math.Min(float64(g.max), limit))
+	return g.Limit()
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if max > 0 && v > max {
+		return max
+	}
+	return v
+}
+
+// WithDropClassifier tells an AdaptiveLimiter which errors of Call.Done are load related,
+// default context.DeadlineExceeded and ErrOverloaded
+func WithDropClassifier(fn func(err error) bool) Option {
+	return func(c *config) {
+		c.isDrop = fn
+	}
+}
+
+func isDrop(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrOverloaded)
+}
+
+// AdaptiveLimiter limits the calls in flight to a limit its Algorithm keeps adjusting
+// from the latency and the drops of finished calls.
+//
+// Waiters are served in FIFO order once calls finish or the limit grows.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	algo     Algorithm
+	clock    Clock
+	isDrop   func(err error) bool
+	limit    int
+	inFlight int
+	waiters  list.List // of *waiter
+}
+
+// waiter waits for n slots at once
+type waiter struct {
+	n     int
+	ready chan struct{}
+}
+
+func NewAdaptive(algo Algorithm, opts ...Option) *AdaptiveLimiter {
+	c := newConfig(opts)
+	a := &AdaptiveLimiter{
+		algo:   algo,
+		clock:  c.clock,
+		isDrop: c.isDrop,
+		limit:  algo.Limit(),
+	}
+	if a.isDrop == nil {
+		a.isDrop = isDrop
+	}
+	if a.limit < 1 {
+		a.limit = 1
+	}
+	return a
+}
+
+// Call is an admitted call, it must be finished with exactly one of Done, Success, Dropped or Ignore
+type Call struct {
+	a        *AdaptiveLimiter
+	start    time.Time
+	inFlight int
+	n        int // slots taken
+	once     sync.Once
+}
+
+// Acquire admits a call, waiting while the limit is reached until ctx is done
+func (a *AdaptiveLimiter) Acquire(ctx context.Context) (*Call, error) {
+	return a.acquire(ctx, 1)
+}
+
+// acquire admits a call taking n slots at once, it never holds some of them while waiting
+// for the rest
+func (a *AdaptiveLimiter) acquire(ctx context.Context, n int) (*Call, error) {
+	a.mu.Lock()
+	if a.fits(n) && a.waiters.Len() == 0 {
+		call := a.admit(n)
+		a.mu.Unlock()
+		return call, nil
+	}
+
+	w := &waiter{n: n, ready: make(chan struct{})}
+	elem := a.waiters.PushBack(w)
+	a.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.newCall(n), nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// admitted meanwhile, hand the slots on
+			a.inFlight -= n
+		default:
+			a.waiters.Remove(elem)
+		}
+		// the waiters behind may fit now
+		a.wake()
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire admits a call if the limit allows it right now
+func (a *AdaptiveLimiter) TryAcquire() (*Call, bool) {
+	return a.tryAcquire(1)
+}
+
+func (a *AdaptiveLimiter) tryAcquire(n int) (*Call, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.fits(n) || a.waiters.Len() > 0 {
+		return nil, false
+	}
+	return a.admit(n), true
+}
+
+// Limit returns the current concurrency limit
+func (a *AdaptiveLimiter) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.limit
+}
+
+// InFlight returns the calls admitted and not finished yet
+func (a *AdaptiveLimiter) InFlight() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.inFlight
+}
+
+// fits reports whether n slots are free, more than the limit fit when nothing is in flight
+// so a large call is not stuck when the limit shrinks. The lock must be held.
+func (a *AdaptiveLimiter) fits(n int) bool {
+	return a.inFlight == 0 || a.inFlight+n <= a.limit
+}
+
+// admit takes n slots, the lock must be held
+func (a *AdaptiveLimiter) admit(n int) *Call {
+	a.inFlight += n
+	return a.newCall(n)
+}
+
+func (a *AdaptiveLimiter) newCall(n int) *Call {
+	return &Call{a: a, start: a.clock.Now(), inFlight: a.inFlight, n: n}
+}
+
+// wake hands free slots to the waiters in order, the lock must be held
+func (a *AdaptiveLimiter) wake() {
+	for a.waiters.Len() > 0 {
+		w := a.waiters.Front().Value.(*waiter)
+		if !a.fits(w.n) {
+			return
+		}
+		a.waiters.Remove(a.waiters.Front())
+		a.inFlight += w.n
+		close(w.ready)
+	}
+}
+
+func (a *AdaptiveLimiter) finish(c *Call, sample bool, dropped bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight -= c.n
+	if sample {
+		rtt := a.clock.Now().Sub(c.start)
+		a.limit = a.algo.Update(Sample{RTT: rtt, InFlight: c.inFlight, Dropped: dropped})
+		if a.limit < 1 {
+			a.limit = 1
+		}
+	}
+	a.wake()
+}
+
+// Done finishes the call, err decides whether it counts as a success, a drop or is ignored
+func (c *Call) Done(err error) {
+	switch {
+	case err == nil:
+		c.Success()
+	case c.a.isDrop(err):
+		c.Dropped()
+	default:
+		c.Ignore()
+	}
+}
+
+// Success finishes the call and feeds its latency to the algorithm
+func (c *Call) Success() {
+	c.once.Do(func() { c.a.finish(c, true, false) })
+}
+
+// Dropped finishes the call as failed because of load, e.g. a timeout
+func (c *Call) Dropped() {
+	c.once.Do(func() { c.a.finish(c, true, true) })
+}
+
+// Ignore finishes the call without telling the algorithm, e.g. for errors unrelated to load
+func (c *Call) Ignore() {
+	c.once.Do(func() { c.a.finish(c, false, false) })
+}
+
+// AdaptiveSemaphore has the methods of sema.Semaphore on top of an AdaptiveLimiter.
+// An Acquire of n units is one call taking n slots and one latency sample.
+//
+// Release has no handle of the caller, it finishes the oldest call of exactly n units
+// and only splits older calls when there is none, so callers that release what they
+// acquired are sampled with their own start.
+type AdaptiveSemaphore struct {
+	a       *AdaptiveLimiter
+	timeout time.Duration
+	mu      sync.Mutex
+	calls   list.List // of *Call, oldest first
+}
+
+// Semaphore returns a sema.Semaphore replacement limited by a, a timeout > 0 bounds every Acquire
+func (a *AdaptiveLimiter) Semaphore(timeout time.Duration) *AdaptiveSemaphore {
+	return &AdaptiveSemaphore{a: a, timeout: timeout}
+}
+
+// Acquire admits n units at once, on failure none is admitted
+func (s *AdaptiveSemaphore) Acquire(ctx context.Context, n int) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	call, err := s.a.acquire(ctx, n)
+	if err != nil {
+		return err
+	}
+	s.push(call)
+	return nil
+}
+
+// TryAcquire admits n units if the limit allows all of them right now
+func (s *AdaptiveSemaphore) TryAcquire(n int) bool {
+	call, ok := s.a.tryAcquire(n)
+	if ok {
+		s.push(call)
+	}
+	return ok
+}
+
+// Release finishes n units as a success
+func (s *AdaptiveSemaphore) Release(n int) {
+	for _, call := range s.pop(n) {
+		call.Success()
+	}
+}
+
+// Drop finishes n units as failed because of load
+func (s *AdaptiveSemaphore) Drop(n int) {
+	for _, call := range s.pop(n) {
+		call.Dropped()
+	}
+}
+
+// SpareSem returns the calls that may still start under the current limit
+func (s *AdaptiveSemaphore) SpareSem() int {
+	s.a.mu.Lock()
+	defer s.a.mu.Unlock()
+
+	if spare := s.a.limit - s.a.inFlight; spare > 0 {
+		return spare
+	}
+	return 0
+}
+
+func (s *AdaptiveSemaphore) push(call *Call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls.PushBack(call)
+}
+
+// pop takes the calls holding n units, the oldest of exactly n units if there is one
+// or else the oldest ones, the last of them split when it holds more than needed
+func (s *AdaptiveSemaphore) pop(n int) []*Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for e := s.calls.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Call).n == n {
+			return []*Call{s.calls.Remove(e).(*Call)}
+		}
+	}
+
+	held := 0
+	for e := s.calls.Front(); e != nil && held < n; e = e.Next() {
+		held += e.Value.(*Call).n
+	}
+	if n > held {
+		panic("can not release")
+	}
+
+	var calls []*Call
+	for n > 0 {
+		call := s.calls.Front().Value.(*Call)
+		if call.n > n {
+			call.n -= n
+			calls = append(calls, &Call{a: call.a, start: call.start, inFlight: call.inFlight, n: n})
+			break
+		}
+		s.calls.Remove(s.calls.Front())
+		calls = append(calls, call)
+		n -= call.n
+	}
+	return calls
+}
@@ -0,0 +1,219 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAIMD(t *testing.T) {
+	a := NewAIMD(10, 2, 12)
+	for i := 0; i < 5; i++ {
+		a.Update(Sample{RTT: time.Millisecond, InFlight: 10})
+	}
+	if a.Limit() != 12 {
+		t.Fatalf("limit: %d, want max 12", a.Limit())
+	}
+	a.Update(Sample{RTT: time.Millisecond, InFlight: 1})
+	if a.Limit() != 12 {
+		t.Fatalf("limit grew without load: %d", a.Limit())
+	}
+	a.Update(Sample{Dropped: true})
+	if a.Limit() != 10 {
+		t.Fatalf("limit after drop: %d, want 10", a.Limit())
+	}
+}
+
+func TestVegas(t *testing.T) {
+	v := NewVegas(20, 100)
+	v.Update(Sample{RTT: 10 * time.Millisecond, InFlight: 20})
+	v.Update(Sample{RTT: 10 * time.Millisecond, InFlight: 20})
+	if v.Limit() <= 20 {
+		t.Fatalf("limit without queueing: %d, want growth", v.Limit())
+	}
+
+	grown := v.Limit()
+	for i := 0; i < 10; i++ {
+		v.Update(Sample{RTT: 50 * time.Millisecond, InFlight: v.Limit()})
+	}
+	if v.Limit() >= grown {
+		t.Fatalf("limit with queueing: %d, want below %d", v.Limit(), grown)
+	}
+}
+
+func TestGradient2(t *testing.T) {
+	g := NewGradient2(50, 5, 200)
+	for i := 0; i < 100; i++ {
+		g.Update(Sample{RTT: 10 * time.Millisecond, InFlight: g.Limit()})
+	}
+	steady := g.Limit()
+	if steady <= 50 {
+		t.Fatalf("limit at steady latency: %d, want growth", steady)
+	}
+
+	for i := 0; i < 20; i++ {
+		g.Update(Sample{RTT: 100 * time.Millisecond, InFlight: g.Limit()})
+	}
+	if g.Limit() >= steady {
+		t.Fatalf("limit at 10x latency: %d, want below %d", g.Limit(), steady)
+	}
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	a := NewAdaptive(NewAIMD(2, 1, 2))
+
+	c1, _ := a.TryAcquire()
+	c2, _ := a.TryAcquire()
+	if _, ok := a.TryAcquire(); ok {
+		t.Fatal("third call was admitted with limit 2")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := a.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	got := make(chan *Call)
+	go func() {
+		c, _ := a.Acquire(context.Background())
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c1.Done(nil)
+	c3 := <-got
+
+	c2.Done(context.DeadlineExceeded)
+	if a.Limit() != 1 {
+		t.Fatalf("limit after drop: %d, want 1", a.Limit())
+	}
+	c3.Success()
+	if a.InFlight() != 0 {
+		t.Fatalf("in flight: %d, want 0", a.InFlight())
+	}
+}
+
+func TestAdaptiveSemaphore(t *testing.T) {
+	s := NewAdaptive(NewAIMD(2, 1, 2)).Semaphore(5 * time.Millisecond)
+	if err := s.Acquire(context.Background(), 2); err != nil || s.SpareSem() != 0 {
+		t.Fatalf("first Acquire: %v, spare %d", err, s.SpareSem())
+	}
+	if s.Acquire(context.Background(), 1) == nil || s.TryAcquire(1) {
+		t.Fatal("Acquire beyond the limit succeeded")
+	}
+	s.Release(1)
+	if s.TryAcquire(2) || !s.TryAcquire(1) {
+		t.Fatal("TryAcquire after Release did not admit exactly one call")
+	}
+}
+
+func TestAdaptiveSemaphoreMultiUnit(t *testing.T) {
+	s := NewAdaptive(NewAIMD(4, 4, 4)).Semaphore(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := s.Acquire(context.Background(), 3); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+				s.Release(3)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("deadlocked with %d in flight", s.a.InFlight())
+	}
+	if s.SpareSem() != 4 {
+		t.Fatalf("spare after all releases: %d, want 4", s.SpareSem())
+	}
+}
+
+// recordAlgo keeps its limit and records the samples
+type recordAlgo struct {
+	limit   int
+	samples *[]Sample
+}
+
+func (r *recordAlgo) Limit() int { return r.limit }
+
+func (r *recordAlgo) Update(s Sample) int {
+	*r.samples = append(*r.samples, s)
+	return r.limit
+}
+
+func TestAdaptiveSemaphoreOwnStart(t *testing.T) {
+	clock := newFakeClock()
+	var samples []Sample
+	a := NewAdaptive(&recordAlgo{limit: 10, samples: &samples}, WithClock(clock))
+	s := a.Semaphore(0)
+
+	s.Acquire(context.Background(), 1)
+	clock.Advance(time.Second)
+	s.Acquire(context.Background(), 2)
+	clock.Advance(time.Second)
+	s.Release(2)
+	if len(samples) != 1 || samples[0].RTT != time.Second {
+		t.Fatalf("samples: %+v, want one of the 2 units with an rtt of 1s", samples)
+	}
+	s.Release(1)
+	if len(samples) != 2 || samples[1].RTT != 2*time.Second {
+		t.Fatalf("samples: %+v, want the single unit with an rtt of 2s", samples)
+	}
+}
+
+func TestAdaptiveMiddleware(t *testing.T) {
+	a := NewAdaptive(NewAIMD(1, 1, 1))
+	block := make(chan struct{})
+	h := AdaptiveMiddleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	for a.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status: %d, want 503", rec.Code)
+	}
+	close(block)
+	<-done
+}
+
+func TestAdaptiveMiddlewarePanic(t *testing.T) {
+	a := NewAdaptive(NewAIMD(2, 1, 2))
+	srv := httptest.NewServer(AdaptiveMiddleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		if resp, err := http.Get(srv.URL); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if a.InFlight() != 0 {
+		t.Fatalf("in flight after panics: %d, want 0", a.InFlight())
+	}
+}
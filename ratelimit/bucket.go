@@ -0,0 +1,185 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket refills limit tokens per duration up to burst, an event takes one token.
+// Reservations may borrow future tokens, their Delay tells when the token is refilled.
+type TokenBucket struct {
+	mu       sync.Mutex
+	clock    Clock
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(limit int, per time.Duration, burst int, opts ...Option) *TokenBucket {
+	c := newConfig(opts)
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		clock:    c.clock,
+		interval: interval(limit, per),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     c.clock.Now(),
+	}
+}
+
+func (b *TokenBucket) Allow() bool {
+	return allow(b)
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	return wait(ctx, b)
+}
+
+func (b *TokenBucket) Reserve() *Reservation {
+	return b.ReserveN(1)
+}
+
+// ReserveN books n events at once, e.g. n bytes of a bandwidth limit
+func (b *TokenBucket) ReserveN(n int) *Reservation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	cancel := func() { b.giveBack(n) }
+	if b.tokens >= 0 {
+		return &Reservation{ok: true, cancel: cancel}
+	}
+	return &Reservation{
+		ok:     true,
+		delay:  durationOf(-b.tokens * float64(b.interval)),
+		cancel: cancel,
+	}
+}
+
+// WaitN blocks until n events may happen or ctx is done
+func (b *TokenBucket) WaitN(ctx context.Context, n int) error {
+	r := b.ReserveN(n)
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		r.Cancel()
+		return ErrLimitExceeded
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// Burst returns the most events the bucket holds
+func (b *TokenBucket) Burst() int {
+	return int(b.burst)
+}
+
+// Tokens returns the tokens available now, negative when reservations are pending
+func (b *TokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens
+}
+
+func (b *TokenBucket) refill() {
+	now := b.clock.Now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(b.interval)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// durationOf converts nanoseconds to a duration without overflowing
+func durationOf(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(ns)
+}
+
+func (b *TokenBucket) giveBack(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// LeakyBucket lets events through evenly spaced at limit per duration, like go.uber.org/ratelimit.
+// At most capacity events may queue for their turn, 0 means no bound.
+type LeakyBucket struct {
+	mu       sync.Mutex
+	clock    Clock
+	interval time.Duration
+	capacity int
+	next     time.Time
+}
+
+func NewLeakyBucket(limit int, per time.Duration, capacity int, opts ...Option) *LeakyBucket {
+	c := newConfig(opts)
+	return &LeakyBucket{
+		clock:    c.clock,
+		interval: interval(limit, per),
+		capacity: capacity,
+	}
+}
+
+func (b *LeakyBucket) Allow() bool {
+	return allow(b)
+}
+
+func (b *LeakyBucket) Wait(ctx context.Context) error {
+	return wait(ctx, b)
+}
+
+func (b *LeakyBucket) Reserve() *Reservation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+
+	delay := b.next.Sub(now)
+	if b.capacity > 0 {
+		if queued := time.Duration(b.capacity) * b.interval; delay > queued {
+			return &Reservation{delay: delay - queued}
+		}
+	}
+
+	b.next = b.next.Add(b.interval)
+	return &Reservation{ok: true, delay: delay, cancel: b.giveBack}
+}
+
+func (b *LeakyBucket) giveBack() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.next = b.next.Add(-b.interval)
+}
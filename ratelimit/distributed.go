@@ -0,0 +1,252 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStoreContention is returned when a GCRA update keeps losing its compare-and-swap
+	ErrStoreContention = errors.New("ratelimit: store contention")
+)
+
+const maxSwapAttempts = 8
+
+// WithBatch makes a distributed limiter lease n events per store round trip and hand them out locally.
+// Larger batches mean fewer round trips but a coarser share of the quota between replicas.
+func WithBatch(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.batch = n
+		}
+	}
+}
+
+// WithFallback sets the limiter deciding while the store fails, default Unlimited
+func WithFallback(l Limiter) Option {
+	return func(c *config) {
+		c.fallback = l
+	}
+}
+
+// lease is a share of the global quota taken from the store, consumed locally
+type lease struct {
+	tokens  int
+	expires time.Time
+}
+
+func (l *lease) take(now time.Time) bool {
+	if l.tokens <= 0 || !now.Before(l.expires) {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// DistributedWindow allows limit events per fixed window across all replicas sharing the store.
+// Every window is a counter increased with Store.IncrBy.
+type DistributedWindow struct {
+	mu       sync.Mutex
+	store    Store
+	key      string
+	limit    int
+	window   time.Duration
+	batch    int
+	clock    Clock
+	fallback Limiter
+	lease    lease
+	full     time.Time // the window the store reported as exhausted
+}
+
+func NewDistributedWindow(store Store, key string, limit int, window time.Duration, opts ...Option) *DistributedWindow {
+	c := newConfig(opts)
+	return &DistributedWindow{
+		store:    store,
+		key:      key,
+		limit:    limit,
+		window:   window,
+		batch:    c.batch,
+		clock:    c.clock,
+		fallback: c.fallback,
+	}
+}
+
+func (w *DistributedWindow) Allow() bool {
+	return allow(w)
+}
+
+func (w *DistributedWindow) Wait(ctx context.Context) error {
+	return wait(ctx, w)
+}
+
+func (w *DistributedWindow) Reserve() *Reservation {
+	r, _ := w.ReserveContext(context.Background())
+	return r
+}
+
+// ReserveContext is Reserve with a context for the store, on store errors
+// the reservation of the fallback limiter is returned along with the error
+func (w *DistributedWindow) ReserveContext(ctx context.Context) (*Reservation, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	start := now.Truncate(w.window)
+	end := start.Add(w.window)
+	if w.lease.take(now) {
+		return w.reservation(start), nil
+	}
+	if w.full.Equal(start) || w.limit <= 0 {
+		return &Reservation{delay: end.Sub(now)}, nil
+	}
+
+	key := w.key + ":" + strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)
+	value, _, err := w.store.IncrBy(ctx, key, int64(w.batch), end.Sub(now)+time.Second)
+	if err != nil {
+		return w.fallback.Reserve(), err
+	}
+
+	// the counter may have passed the limit by part of the batch
+	granted := int64(w.batch)
+	if over := value - int64(w.limit); over > 0 {
+		granted -= over
+	}
+	if granted <= 0 {
+		w.full = start
+		return &Reservation{delay: end.Sub(now)}, nil
+	}
+
+	w.lease = lease{tokens: int(granted) - 1, expires: end}
+	return w.reservation(start), nil
+}
+
+func (w *DistributedWindow) reservation(start time.Time) *Reservation {
+	return &Reservation{ok: true, cancel: func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if w.lease.expires.Equal(start.Add(w.window)) {
+			w.lease.tokens++
+		}
+	}}
+}
+
+// GCRA is the generic cell rate algorithm across all replicas sharing the store:
+// limit events per duration with bursts of burst, as smooth as a token bucket.
+//
+// The store keeps the theoretical arrival time in unix nanoseconds and is updated
+// with Store.CompareAndSwap, so the clocks of the replicas should be in sync.
+type GCRA struct {
+	mu       sync.Mutex
+	store    Store
+	key      string
+	limit    int
+	interval time.Duration
+	burst    int64
+	batch    int64
+	clock    Clock
+	fallback Limiter
+	lease    lease
+}
+
+func NewGCRA(store Store, key string, limit int, per time.Duration, burst int, opts ...Option) *GCRA {
+	c := newConfig(opts)
+	if burst < 1 {
+		burst = 1
+	}
+	batch := c.batch
+	if batch > burst {
+		batch = burst
+	}
+	return &GCRA{
+		store:    store,
+		key:      key,
+		limit:    limit,
+		interval: interval(limit, per),
+		burst:    int64(burst),
+		batch:    int64(batch),
+		clock:    c.clock,
+		fallback: c.fallback,
+	}
+}
+
+func (g *GCRA) Allow() bool {
+	return allow(g)
+}
+
+func (g *GCRA) Wait(ctx context.Context) error {
+	return wait(ctx, g)
+}
+
+func (g *GCRA) Reserve() *Reservation {
+	r, _ := g.ReserveContext(context.Background())
+	return r
+}
+
+// ReserveContext is Reserve with a context for the store, on store errors
+// the reservation of the fallback limiter is returned along with the error
+func (g *GCRA) ReserveContext(ctx context.Context) (*Reservation, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	if g.lease.take(now) {
+		return g.reservation(), nil
+	}
+	if g.limit <= 0 {
+		// never allowed, Wait blocks until ctx is done without asking the store
+		return &Reservation{delay: time.Duration(math.MaxInt64)}, nil
+	}
+
+	for i := 0; i < maxSwapAttempts; i++ {
+		old, err := g.store.Get(ctx, g.key)
+		if err != nil {
+			return g.fallback.Reserve(), err
+		}
+
+		tat := old
+		if tat < now.UnixNano() {
+			tat = now.UnixNano()
+		}
+
+		// take as much of the batch as the burst still allows
+		room := (now.UnixNano() + g.burst*int64(g.interval) - tat) / int64(g.interval)
+		if room < 1 {
+			delay := time.Duration(tat + int64(g.interval) - now.UnixNano() - g.burst*int64(g.interval))
+			return &Reservation{delay: delay}, nil
+		}
+		n := g.batch
+		if n > room {
+			n = room
+		}
+
+		newTat := tat + n*int64(g.interval)
+		ttl := time.Duration(newTat - now.UnixNano())
+		ok, err := g.store.CompareAndSwap(ctx, g.key, old, newTat, ttl)
+		if err != nil {
+			return g.fallback.Reserve(), err
+		}
+		if ok {
+			// unused leased events lapse once the quota they were taken from has refilled
+			g.lease = lease{tokens: int(n) - 1, expires: now.Add(time.Duration(n) * g.interval)}
+			return g.reservation(), nil
+		}
+	}
+	return g.fallback.Reserve(), ErrStoreContention
+}
+
+func (g *GCRA) reservation() *Reservation {
+	expires := g.lease.expires
+	return &Reservation{ok: true, cancel: func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if g.lease.expires.Equal(expires) {
+			g.lease.tokens++
+		}
+	}}
+}
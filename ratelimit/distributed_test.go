@@ -0,0 +1,365 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respServer is a tiny stand-in of redis, it knows the commands RedisStore sends
+type respServer struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+func newRESPServer(t *testing.T) *respServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{
+		ln:       ln,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		versions: make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *respServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	var (
+		queued  [][]string
+		multi   bool
+		watched = make(map[string]int)
+	)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			multi = true
+			w.WriteString("+OK\r\n")
+		case cmd == "EXEC":
+			s.mu.Lock()
+			aborted := false
+			for key, version := range watched {
+				if s.versions[key] != version {
+					aborted = true
+				}
+			}
+			if aborted {
+				w.WriteString("*-1\r\n")
+			} else {
+				fmt.Fprintf(w, "*%d\r\n", len(queued))
+				for _, q := range queued {
+					w.WriteString(s.exec(q))
+				}
+			}
+			s.mu.Unlock()
+			multi, queued, watched = false, nil, make(map[string]int)
+		case multi:
+			queued = append(queued, args)
+			w.WriteString("+QUEUED\r\n")
+		case cmd == "WATCH":
+			s.mu.Lock()
+			for _, key := range args[1:] {
+				watched[key] = s.versions[key]
+			}
+			s.mu.Unlock()
+			w.WriteString("+OK\r\n")
+		case cmd == "UNWATCH":
+			watched = make(map[string]int)
+			w.WriteString("+OK\r\n")
+		default:
+			s.mu.Lock()
+			w.WriteString(s.exec(args))
+			s.mu.Unlock()
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+// exec runs one command and returns its reply, the lock must be held
+func (s *respServer) exec(args []string) string {
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if exp, ok := s.expires[key]; ok && !time.Now().Before(exp) {
+			s.del(key)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := s.values[key]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		var (
+			px time.Duration
+			nx bool
+		)
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				px = time.Duration(ms) * time.Millisecond
+			}
+		}
+		if _, ok := s.values[key]; ok && nx {
+			return "$-1\r\n"
+		}
+		s.values[key] = args[2]
+		delete(s.expires, key)
+		if px > 0 {
+			s.expires[key] = time.Now().Add(px)
+		}
+		s.versions[key]++
+		return "+OK\r\n"
+	case "INCRBY":
+		n, _ := strconv.ParseInt(args[2], 10, 64)
+		cur, err := strconv.ParseInt(s.valueOr(key, "0"), 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		s.values[key] = strconv.FormatInt(cur+n, 10)
+		s.versions[key]++
+		return fmt.Sprintf(":%d\r\n", cur+n)
+	case "PTTL":
+		if _, ok := s.values[key]; !ok {
+			return ":-2\r\n"
+		}
+		exp, ok := s.expires[key]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(exp).Milliseconds())
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func (s *respServer) valueOr(key, def string) string {
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (s *respServer) del(key string) {
+	delete(s.values, key)
+	delete(s.expires, key)
+	s.versions[key]++
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// countReplicas lets the replicas take turns until none of them allows an event anymore
+func countReplicas(replicas ...Limiter) (allowed int) {
+	for {
+		before := allowed
+		for _, l := range replicas {
+			if l.Allow() {
+				allowed++
+			}
+		}
+		if allowed == before {
+			return
+		}
+	}
+}
+
+func TestDistributedWindow(t *testing.T) {
+	clock := newFakeClock()
+	store := NewMemoryStore(WithClock(clock))
+	a := NewDistributedWindow(store, "api", 10, time.Minute, WithClock(clock), WithBatch(3))
+	b := NewDistributedWindow(store, "api", 10, time.Minute, WithClock(clock), WithBatch(3))
+
+	if n := countReplicas(a, b); n != 10 {
+		t.Fatalf("allowed: %d, want 10", n)
+	}
+	if r := a.Reserve(); r.OK() || r.Delay() != time.Minute {
+		t.Fatalf("reserve: %v %v, want false 1m", r.OK(), r.Delay())
+	}
+
+	clock.Advance(time.Minute)
+	if n := countReplicas(a, b); n != 10 {
+		t.Fatalf("allowed in the next window: %d, want 10", n)
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	clock := newFakeClock()
+	store := NewMemoryStore(WithClock(clock))
+	a := NewGCRA(store, "api", 10, time.Second, 5, WithClock(clock), WithBatch(2))
+	b := NewGCRA(store, "api", 10, time.Second, 5, WithClock(clock), WithBatch(2))
+
+	if n := countReplicas(a, b); n != 5 {
+		t.Fatalf("allowed: %d, want burst 5", n)
+	}
+	if r := b.Reserve(); r.OK() || r.Delay() != 100*time.Millisecond {
+		t.Fatalf("reserve: %v %v, want false 100ms", r.OK(), r.Delay())
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	if n := countReplicas(a, b); n != 2 {
+		t.Fatalf("allowed after 200ms: %d, want 2", n)
+	}
+}
+
+// countingStore counts the round trips to the store
+type countingStore struct {
+	Store
+	calls int32
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (int64, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return s.Store.Get(ctx, key)
+}
+
+func TestGCRAZeroLimit(t *testing.T) {
+	store := &countingStore{Store: NewMemoryStore()}
+	g := NewGCRA(store, "api", 0, time.Second, 5)
+	if g.Allow() {
+		t.Fatal("limit 0 allowed an event")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); err != ErrLimitExceeded {
+		t.Fatalf("Wait: %v, want %v", err, ErrLimitExceeded)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := g.Wait(ctx); err != context.Canceled {
+		t.Fatalf("Wait: %v, want %v", err, context.Canceled)
+	}
+	if n := atomic.LoadInt32(&store.calls); n != 0 {
+		t.Fatalf("store asked %d times, want never", n)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	srv := newRESPServer(t)
+	store := NewRedisStore(srv.Addr())
+	defer store.Close()
+	ctx := context.Background()
+
+	for i, want := range []int64{3, 6} {
+		v, ttl, err := store.IncrBy(ctx, "counter", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want || ttl <= 0 || ttl > time.Minute {
+			t.Fatalf("IncrBy %d: %d %v, want %d and a ttl", i, v, ttl, want)
+		}
+	}
+
+	if ok, err := store.CompareAndSwap(ctx, "tat", 0, 42, time.Minute); !ok || err != nil {
+		t.Fatalf("CompareAndSwap on a missing key: %v %v", ok, err)
+	}
+	if ok, err := store.CompareAndSwap(ctx, "tat", 0, 43, time.Minute); ok || err != nil {
+		t.Fatalf("CompareAndSwap with a stale value: %v %v", ok, err)
+	}
+	if v, err := store.Get(ctx, "tat"); v != 42 || err != nil {
+		t.Fatalf("Get: %d %v, want 42", v, err)
+	}
+
+	a := NewGCRA(store, "gcra", 1, time.Hour, 3)
+	b := NewGCRA(NewRedisStore(srv.Addr()), "gcra", 1, time.Hour, 3)
+	if n := countReplicas(a, b); n != 3 {
+		t.Fatalf("gcra allowed: %d, want 3", n)
+	}
+}
+
+func TestStoreFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := NewRedisStore(addr, WithRedisTimeout(100*time.Millisecond))
+	w := NewDistributedWindow(store, "api", 10, time.Minute)
+	if _, err := w.ReserveContext(context.Background()); err == nil {
+		t.Fatal("unreachable store did not fail")
+	}
+	if !w.Allow() {
+		t.Fatal("default fallback denied the event")
+	}
+
+	w = NewDistributedWindow(store, "api", 10, time.Minute, WithFallback(NewFixedWindow(0, time.Minute)))
+	if w.Allow() {
+		t.Fatal("fallback allowed the event")
+	}
+}
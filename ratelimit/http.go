@@ -0,0 +1,207 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc picks the key a request is limited by, requests with an empty key are not limited
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP keys requests by the ip of the remote address
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader keys requests by a header, e.g. an api key or the X-Real-IP set by a proxy
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// KeyByRoute keys requests by method and path
+func KeyByRoute(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+type MiddlewareOption func(m *middleware)
+
+// WithKeyFunc sets how requests are keyed, default KeyByIP
+func WithKeyFunc(fn KeyFunc) MiddlewareOption {
+	return func(m *middleware) {
+		m.keyFunc = fn
+	}
+}
+
+// WithDryRun only reports limited requests to the OnLimited callback and lets them through
+func WithDryRun(dryRun bool) MiddlewareOption {
+	return func(m *middleware) {
+		m.dryRun = dryRun
+	}
+}
+
+// WithOnLimited is called for every limited request, also in dry run mode
+func WithOnLimited(fn func(r *http.Request, key string)) MiddlewareOption {
+	return func(m *middleware) {
+		m.onLimited = fn
+	}
+}
+
+// WithLimitedHandler replaces the default plain 429 response, the headers are already set when it runs
+func WithLimitedHandler(h http.Handler) MiddlewareOption {
+	return func(m *middleware) {
+		m.limited = h
+	}
+}
+
+type middleware struct {
+	kl        *KeyedLimiter
+	keyFunc   KeyFunc
+	dryRun    bool
+	onLimited func(r *http.Request, key string)
+	limited   http.Handler
+}
+
+// Middleware limits the requests of every key with kl.
+//
+// Responses carry RateLimit-Limit and, for token bucket limiters, RateLimit-Remaining and RateLimit-Reset.
+// Limited requests get 429 Too Many Requests with Retry-After.
+func Middleware(kl *KeyedLimiter, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	m := &middleware{
+		kl:      kl,
+		keyFunc: KeyByIP,
+		limited: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := m.keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			l := m.kl.Get(key)
+			ok, retryAfter := try(l)
+			if !m.dryRun {
+				setHeaders(w.Header(), l, m.kl.templateOf(key).Limit)
+			}
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if m.onLimited != nil {
+				m.onLimited(r, key)
+			}
+			if m.dryRun {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(retryAfter)))
+			m.limited.ServeHTTP(w, r)
+		})
+	}
+}
+
+// try is Allow also returning when to retry
+func try(l Limiter) (bool, time.Duration) {
+	r := l.Reserve()
+	if !r.OK() {
+		return false, r.Delay()
+	}
+	if r.Delay() > 0 {
+		r.Cancel()
+		return false, r.Delay()
+	}
+	return true, 0
+}
+
+func setHeaders(h http.Header, l Limiter, limit int) {
+	if limit <= 0 {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(limit))
+
+	b, ok := l.(*TokenBucket)
+	if !ok {
+		return
+	}
+	tokens := b.Tokens()
+	remaining := int(math.Max(math.Floor(tokens), 0))
+	reset := durationOf((b.burst - tokens) * float64(b.interval))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+}
+
+// seconds rounds d up to whole seconds as the headers want them
+func seconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// AdaptiveMiddleware sheds requests beyond the concurrency limit of a with 503 Service Unavailable.
+// Responses 429, 503 and 504 of next and expired request contexts count as drops,
+// a panic of next frees the slot without a sample and is passed on.
+func AdaptiveMiddleware(a *AdaptiveLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call, ok := a.TryAcquire()
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				// a panic, e.g. http.ErrAbortHandler, says nothing about the load
+				if v := recover(); v != nil {
+					call.Ignore()
+					panic(v)
+				}
+			}()
+			next.ServeHTTP(rec, r)
+
+			switch {
+			case r.Context().Err() == context.DeadlineExceeded:
+				call.Dropped()
+			case rec.status == http.StatusTooManyRequests,
+				rec.status == http.StatusServiceUnavailable,
+				rec.status == http.StatusGatewayTimeout:
+				call.Dropped()
+			default:
+				call.Success()
+			}
+		})
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	kl := NewKeyed(Template{Limit: 1, Per: 10 * time.Second, Burst: 2}, WithClock(newFakeClock()))
+	h := Middleware(kl, WithKeyFunc(KeyByHeader("X-Api-Key")))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("a"); rec.Code != http.StatusNoContent || rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("first: %d remaining %q", rec.Code, rec.Header().Get("RateLimit-Remaining"))
+	}
+	do("a")
+	rec := do("a")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third: %d, want 429", rec.Code)
+	}
+	for header, want := range map[string]string{
+		"Retry-After":         "10",
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "20",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Fatalf("%s: %q, want %q", header, got, want)
+		}
+	}
+
+	if rec := do(""); rec.Code != http.StatusNoContent {
+		t.Fatalf("request without key: %d", rec.Code)
+	}
+}
+
+func TestMiddlewareDryRun(t *testing.T) {
+	kl := NewKeyed(Template{Limit: 1, Per: time.Hour}, WithClock(newFakeClock()))
+	limited := 0
+	h := Middleware(kl, WithDryRun(true), WithOnLimited(func(r *http.Request, key string) {
+		limited++
+	}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Retry-After") != "" {
+			t.Fatalf("dry run response: %d %v", rec.Code, rec.Header())
+		}
+	}
+	if limited != 2 {
+		t.Fatalf("limited: %d, want 2", limited)
+	}
+}
@@ -0,0 +1,309 @@
+package ratelimiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultShards = 32
+
+// Template describes the limiter of a key: Limit events Per duration with bursts of Burst.
+//
+// In JSON Per is a duration string such as "1m", e.g. {"limit": 100, "per": "1m", "burst": 10}.
+type Template struct {
+	Limit int           `json:"limit"`
+	Per   time.Duration `json:"per"`
+	Burst int           `json:"burst"`
+}
+
+// New builds the token bucket of the template, a Limit <= 0 is unlimited like Add
+func (t Template) New(opts ...Option) Limiter {
+	if t.Limit <= 0 {
+		return Unlimited
+	}
+	per := t.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return NewTokenBucket(t.Limit, per, t.Burst, opts...)
+}
+
+func (t *Template) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Limit int             `json:"limit"`
+		Per   json.RawMessage `json:"per"`
+		Burst int             `json:"burst"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	t.Limit, t.Burst, t.Per = raw.Limit, raw.Burst, 0
+	if len(raw.Per) == 0 || string(raw.Per) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw.Per, &s); err == nil {
+		per, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("ratelimit: template per: %w", err)
+		}
+		t.Per = per
+		return nil
+	}
+	return json.Unmarshal(raw.Per, (*int64)(&t.Per))
+}
+
+func (t Template) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Limit int    `json:"limit"`
+		Per   string `json:"per"`
+		Burst int    `json:"burst"`
+	}{t.Limit, t.Per.String(), t.Burst})
+}
+
+// Factory builds the limiter of key from its template, which is the override of key if any
+type Factory func(key string, t Template) Limiter
+
+// KeyedLimiter limits every key on its own, e.g. per user or per client ip.
+//
+// The limiter of a key is created from the template on its first event,
+// keys idle for longer than the idle ttl are forgotten again.
+type KeyedLimiter struct {
+	template Template
+	factory  Factory
+	clock    Clock
+	idleTTL  time.Duration
+	shards   []*keyedShard
+
+	mu        sync.RWMutex
+	overrides map[string]Template
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type keyedShard struct {
+	sync.Mutex
+	entries map[string]*keyedEntry
+}
+
+type keyedEntry struct {
+	limiter  Limiter
+	lastSeen time.Time
+}
+
+// NewKeyed returns a KeyedLimiter creating the limiters of keys from t.
+// With WithIdleTTL a background cleaner runs until Close.
+func NewKeyed(t Template, opts ...Option) *KeyedLimiter {
+	c := newConfig(opts)
+	kl := &KeyedLimiter{
+		template:  t,
+		factory:   c.factory,
+		clock:     c.clock,
+		idleTTL:   c.idleTTL,
+		shards:    make([]*keyedShard, c.shards),
+		overrides: make(map[string]Template),
+		stop:      make(chan struct{}),
+	}
+	if kl.factory == nil {
+		kl.factory = func(key string, t Template) Limiter {
+			return t.New(WithClock(kl.clock))
+		}
+	}
+	for i := range kl.shards {
+		kl.shards[i] = &keyedShard{entries: make(map[string]*keyedEntry)}
+	}
+
+	if kl.idleTTL > 0 {
+		go kl.cleaner()
+	}
+	return kl
+}
+
+func (kl *KeyedLimiter) Allow(key string) bool {
+	return kl.Get(key).Allow()
+}
+
+func (kl *KeyedLimiter) Reserve(key string) *Reservation {
+	return kl.Get(key).Reserve()
+}
+
+func (kl *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	return kl.Get(key).Wait(ctx)
+}
+
+// Get returns the limiter of key, creating it if needed
+func (kl *KeyedLimiter) Get(key string) Limiter {
+	s := kl.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	now := kl.clock.Now()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &keyedEntry{limiter: kl.factory(key, kl.templateOf(key))}
+		s.entries[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+// Del forgets key, its next event starts with a fresh limiter
+func (kl *KeyedLimiter) Del(key string) {
+	s := kl.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.entries, key)
+}
+
+// Len returns the number of keys currently tracked
+func (kl *KeyedLimiter) Len() int {
+	n := 0
+	for _, s := range kl.shards {
+		s.Lock()
+		n += len(s.entries)
+		s.Unlock()
+	}
+	return n
+}
+
+// Evict forgets the keys idle for longer than the idle ttl and returns how many were dropped
+func (kl *KeyedLimiter) Evict() int {
+	if kl.idleTTL <= 0 {
+		return 0
+	}
+
+	deadline := kl.clock.Now().Add(-kl.idleTTL)
+	n := 0
+	for _, s := range kl.shards {
+		s.Lock()
+		for key, e := range s.entries {
+			if e.lastSeen.Before(deadline) {
+				delete(s.entries, key)
+				n++
+			}
+		}
+		s.Unlock()
+	}
+	return n
+}
+
+// SetOverride makes key use t instead of the default template, the current limiter of key is dropped
+func (kl *KeyedLimiter) SetOverride(key string, t Template) {
+	kl.mu.Lock()
+	kl.overrides[key] = t
+	kl.mu.Unlock()
+
+	kl.Del(key)
+}
+
+// DelOverride makes key use the default template again
+func (kl *KeyedLimiter) DelOverride(key string) {
+	kl.mu.Lock()
+	_, ok := kl.overrides[key]
+	delete(kl.overrides, key)
+	kl.mu.Unlock()
+
+	if ok {
+		kl.Del(key)
+	}
+}
+
+// Overrides returns a copy of the per key templates
+func (kl *KeyedLimiter) Overrides() map[string]Template {
+	kl.mu.RLock()
+	defer kl.mu.RUnlock()
+
+	overrides := make(map[string]Template, len(kl.overrides))
+	for key, t := range kl.overrides {
+		overrides[key] = t
+	}
+	return overrides
+}
+
+// LoadOverrides replaces all overrides with the JSON object of key to Template read from r.
+// Keys whose template changed restart with a fresh limiter.
+func (kl *KeyedLimiter) LoadOverrides(r io.Reader) error {
+	overrides := make(map[string]Template)
+	if err := json.NewDecoder(r).Decode(&overrides); err != nil {
+		return fmt.Errorf("ratelimit: load overrides: %w", err)
+	}
+
+	kl.mu.Lock()
+	old := kl.overrides
+	kl.overrides = overrides
+	kl.mu.Unlock()
+
+	for key, t := range overrides {
+		if ot, ok := old[key]; !ok || ot != t {
+			kl.Del(key)
+		}
+	}
+	for key := range old {
+		if _, ok := overrides[key]; !ok {
+			kl.Del(key)
+		}
+	}
+	return nil
+}
+
+// LoadOverridesFile is LoadOverrides reading the file at path
+func (kl *KeyedLimiter) LoadOverridesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return kl.LoadOverrides(f)
+}
+
+// Close stops the background cleaner
+func (kl *KeyedLimiter) Close() {
+	kl.stopOnce.Do(func() {
+		close(kl.stop)
+	})
+}
+
+func (kl *KeyedLimiter) templateOf(key string) Template {
+	kl.mu.RLock()
+	defer kl.mu.RUnlock()
+
+	if t, ok := kl.overrides[key]; ok {
+		return t
+	}
+	return kl.template
+}
+
+func (kl *KeyedLimiter) shard(key string) *keyedShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return kl.shards[h.Sum32()%uint32(len(kl.shards))]
+}
+
+func (kl *KeyedLimiter) cleaner() {
+	interval := kl.idleTTL / 2
+	if interval <= 0 {
+		interval = kl.idleTTL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			kl.Evict()
+		case <-kl.stop:
+			return
+		}
+	}
+}
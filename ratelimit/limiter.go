@@ -0,0 +1,189 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound = errors.New("ratelimit: key not found")
+	// ErrLimitExceeded is returned by Wait when the wait would outlast the context deadline
+	ErrLimitExceeded = errors.New("ratelimit: limit exceeded")
+)
+
+// Limiter is implemented by every rate limiting algorithm of this package
+type Limiter interface {
+	// Allow reports whether an event may happen now, it never blocks
+	Allow() bool
+	// Reserve books an event, see Reservation
+	Reserve() *Reservation
+	// Wait blocks until an event may happen or ctx is done
+	Wait(ctx context.Context) error
+}
+
+// Reservation is the answer of Limiter.Reserve.
+//
+// When OK is true the event is booked and may happen after Delay.
+// When OK is false nothing is booked and Delay hints when to retry, e.g. as Retry-After.
+type Reservation struct {
+	ok     bool
+	delay  time.Duration
+	cancel func()
+	once   sync.Once
+}
+
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+func (r *Reservation) Delay() time.Duration {
+	return r.delay
+}
+
+// Cancel gives a booked event back to the limiter when it will not happen after all
+func (r *Reservation) Cancel() {
+	if !r.ok || r.cancel == nil {
+		return
+	}
+	r.once.Do(r.cancel)
+}
+
+// Clock tells the limiters what time it is, replace it in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+type Option func(c *config)
+
+type config struct {
+	clock   Clock
+	shards  int
+	idleTTL time.Duration
+	factory Factory
+
+	batch    int
+	fallback Limiter
+
+	isDrop func(err error) bool
+}
+
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithShards sets the number of independently locked shards of a KeyedLimiter, default 32
+func WithShards(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.shards = n
+		}
+	}
+}
+
+// WithIdleTTL makes a KeyedLimiter forget keys without events for ttl, 0 keeps them forever.
+// Pick a ttl longer than a full refill so forgetting a key never lets more events through.
+func WithIdleTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.idleTTL = ttl
+	}
+}
+
+// WithFactory replaces how a KeyedLimiter builds the limiter of a key, default Template.New
+func WithFactory(f Factory) Option {
+	return func(c *config) {
+		c.factory = f
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		clock:    realClock{},
+		shards:   defaultShards,
+		batch:    1,
+		fallback: Unlimited,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// interval returns the time between two events for limit events per duration
+func interval(limit int, per time.Duration) time.Duration {
+	if limit <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return per / time.Duration(limit)
+}
+
+// allow is the Allow of limiters whose reservations may be delayed
+func allow(l Limiter) bool {
+	r := l.Reserve()
+	if !r.OK() {
+		return false
+	}
+	if r.Delay() > 0 {
+		r.Cancel()
+		return false
+	}
+	return true
+}
+
+// wait is the Wait shared by all limiters
+func wait(ctx context.Context, l Limiter) error {
+	for {
+		r := l.Reserve()
+		if r.OK() && r.Delay() <= 0 {
+			return nil
+		}
+
+		delay := r.Delay()
+		if delay <= 0 {
+			delay = time.Millisecond
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			r.Cancel()
+			return ErrLimitExceeded
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+			if r.OK() {
+				return nil
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			r.Cancel()
+			return ctx.Err()
+		}
+	}
+}
+
+type unlimited struct{}
+
+// Unlimited is a Limiter allowing every event
+var Unlimited Limiter = unlimited{}
+
+func (unlimited) Allow() bool {
+	return true
+}
+
+func (unlimited) Reserve() *Reservation {
+	return &Reservation{ok: true}
+}
+
+func (unlimited) Wait(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,255 @@
+package ratelimiter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func countAllowed(l Limiter, n int) (allowed int) {
+	for i := 0; i < n; i++ {
+		if l.Allow() {
+			allowed++
+		}
+	}
+	return
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := newFakeClock()
+	b := NewTokenBucket(10, time.Second, 5, WithClock(clock))
+
+	if n := countAllowed(b, 10); n != 5 {
+		t.Fatalf("allowed: %d, want burst 5", n)
+	}
+
+	clock.Advance(200 * time.Millisecond)
+	if n := countAllowed(b, 10); n != 2 {
+		t.Fatalf("allowed: %d, want 2 after 200ms", n)
+	}
+
+	r := b.Reserve()
+	if !r.OK() || r.Delay() != 100*time.Millisecond {
+		t.Fatalf("reserve: %v %v, want true 100ms", r.OK(), r.Delay())
+	}
+	r.Cancel()
+	if tokens := b.Tokens(); tokens != 0 {
+		t.Fatalf("tokens after cancel: %v, want 0", tokens)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	clock := newFakeClock()
+	b := NewLeakyBucket(10, time.Second, 2, WithClock(clock))
+
+	if n := countAllowed(b, 10); n != 1 {
+		t.Fatalf("allowed: %d, want 1", n)
+	}
+
+	r1, r2 := b.Reserve(), b.Reserve()
+	if !r1.OK() || r1.Delay() != 100*time.Millisecond || !r2.OK() || r2.Delay() != 200*time.Millisecond {
+		t.Fatalf("reservations: %v %v, %v %v", r1.OK(), r1.Delay(), r2.OK(), r2.Delay())
+	}
+	if r := b.Reserve(); r.OK() {
+		t.Fatal("reservation beyond capacity was granted")
+	}
+
+	clock.Advance(300 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("event was not allowed after the queue drained")
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	clock := newFakeClock()
+	w := NewFixedWindow(3, time.Minute, WithClock(clock))
+
+	clock.Advance(50 * time.Second)
+	if n := countAllowed(w, 5); n != 3 {
+		t.Fatalf("allowed: %d, want 3", n)
+	}
+	if r := w.Reserve(); r.OK() || r.Delay() != 10*time.Second {
+		t.Fatalf("reserve: %v %v, want false 10s", r.OK(), r.Delay())
+	}
+
+	clock.Advance(10 * time.Second)
+	if n := countAllowed(w, 5); n != 3 {
+		t.Fatalf("allowed: %d, want 3 in the next window", n)
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	clock := newFakeClock()
+	l := NewSlidingLog(3, time.Minute, WithClock(clock))
+
+	l.Allow()
+	clock.Advance(20 * time.Second)
+	l.Allow()
+	l.Allow()
+	if l.Allow() {
+		t.Fatal("fourth event in the window was allowed")
+	}
+	if r := l.Reserve(); r.Delay() != 40*time.Second {
+		t.Fatalf("retry after: %v, want 40s", r.Delay())
+	}
+
+	clock.Advance(40 * time.Second)
+	if n := countAllowed(l, 3); n != 1 {
+		t.Fatalf("allowed: %d, want 1", n)
+	}
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	clock := newFakeClock()
+	w := NewSlidingWindowCounter(10, time.Minute, WithClock(clock))
+
+	if n := countAllowed(w, 20); n != 10 {
+		t.Fatalf("allowed: %d, want 10", n)
+	}
+
+	// a quarter into the next window the previous one still weighs 7.5
+	clock.Advance(75 * time.Second)
+	if n := countAllowed(w, 20); n != 3 {
+		t.Fatalf("allowed: %d, want 3", n)
+	}
+
+	r := w.Reserve()
+	if r.OK() || r.Delay() <= 0 {
+		t.Fatalf("reserve: %v %v, want a retry delay", r.OK(), r.Delay())
+	}
+	clock.Advance(r.Delay())
+	if !w.Allow() {
+		t.Fatal("event was not allowed after the retry delay")
+	}
+}
+
+func TestWait(t *testing.T) {
+	b := NewTokenBucket(100, time.Second, 1)
+	b.Allow()
+
+	start := time.Now()
+	if err := b.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 5*time.Millisecond {
+		t.Fatalf("waited %v, want about 10ms", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := NewFixedWindow(0, time.Hour).Wait(ctx); err != ErrLimitExceeded {
+		t.Fatalf("Wait: %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestGlobalRateLimiter(t *testing.T) {
+	grl := New()
+	if err := grl.Take("missing"); err != ErrKeyNotFound {
+		t.Fatalf("Take: %v, want %v", err, ErrKeyNotFound)
+	}
+	if _, err := grl.Allow("missing"); err != ErrKeyNotFound {
+		t.Fatalf("Allow: %v, want %v", err, ErrKeyNotFound)
+	}
+
+	grl.Add("k", 0)
+	if err := grl.Take("k"); err != nil {
+		t.Fatal(err)
+	}
+
+	grl.AddLimiter("w", NewFixedWindow(1, time.Hour))
+	if ok, _ := grl.Allow("w"); !ok {
+		t.Fatal("first event was not allowed")
+	}
+	if ok, _ := grl.Allow("w"); ok {
+		t.Fatal("second event was allowed")
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	clock := newFakeClock()
+	kl := NewKeyed(Template{Limit: 1, Per: time.Minute, Burst: 2}, WithClock(clock), WithIdleTTL(time.Hour))
+	defer kl.Close()
+
+	for _, key := range []string{"alice", "bob"} {
+		if n := countAllowedKey(kl, key, 5); n != 2 {
+			t.Fatalf("%s allowed: %d, want 2", key, n)
+		}
+	}
+	if kl.Len() != 2 {
+		t.Fatalf("len: %d, want 2", kl.Len())
+	}
+
+	clock.Advance(30 * time.Minute)
+	kl.Allow("alice")
+	clock.Advance(31 * time.Minute)
+	if n := kl.Evict(); n != 1 || kl.Len() != 1 {
+		t.Fatalf("evicted: %d, len %d, want 1 and 1", n, kl.Len())
+	}
+}
+
+func TestKeyedOverrides(t *testing.T) {
+	kl := NewKeyed(Template{Limit: 1, Per: time.Hour, Burst: 1}, WithClock(newFakeClock()))
+	defer kl.Close()
+
+	kl.Allow("vip")
+	if kl.Allow("vip") {
+		t.Fatal("default template allowed a second event")
+	}
+
+	err := kl.LoadOverrides(strings.NewReader(`{"vip": {"limit": 10, "per": "1h", "burst": 3}, "free": {"limit": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countAllowedKey(kl, "vip", 5); n != 3 {
+		t.Fatalf("vip allowed: %d, want 3", n)
+	}
+	if n := countAllowedKey(kl, "free", 100); n != 100 {
+		t.Fatalf("free allowed: %d, want 100", n)
+	}
+	if o := kl.Overrides()["vip"]; o.Per != time.Hour {
+		t.Fatalf("vip per: %v, want 1h", o.Per)
+	}
+
+	kl.DelOverride("vip")
+	if n := countAllowedKey(kl, "vip", 5); n != 1 {
+		t.Fatalf("vip allowed after DelOverride: %d, want 1", n)
+	}
+
+	if err := kl.LoadOverrides(strings.NewReader(`{"x": {"per": "soon"}}`)); err == nil {
+		t.Fatal("invalid duration was accepted")
+	}
+}
+
+func countAllowedKey(kl *KeyedLimiter, key string, n int) (allowed int) {
+	for i := 0; i < n; i++ {
+		if kl.Allow(key) {
+			allowed++
+		}
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package ratelimiter
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener is a net.Listener accepting connections no faster than its limiter allows,
+// the pending connections wait in the backlog of the kernel
+type Listener struct {
+	net.Listener
+	limiter Limiter
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewListener(ln net.Listener, l Limiter) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Listener{
+		Listener: ln,
+		limiter:  l,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (ln *Listener) Accept() (net.Conn, error) {
+	if err := ln.limiter.Wait(ln.ctx); err != nil {
+		if ln.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return ln.Listener.Accept()
+}
+
+// Close closes the listener and wakes up an Accept waiting for the limiter
+func (ln *Listener) Close() error {
+	ln.cancel()
+	return ln.Listener.Close()
+}
+
+// Conn is a net.Conn limiting the bytes read and written per second with token buckets,
+// share a bucket between connections to limit their total bandwidth.
+//
+// The deadlines and Close also end a wait for the buckets, a wait the deadline can not
+// cover fails right away with os.ErrDeadlineExceeded.
+type Conn struct {
+	net.Conn
+	read  *TokenBucket
+	write *TokenBucket
+
+	ctx       context.Context // done on Close
+	cancel    context.CancelFunc
+	readWait  connDeadline
+	writeWait connDeadline
+}
+
+// connDeadline is the context the waits of one direction use, it is replaced and the
+// old one canceled when the deadline changes so the waiting calls pick up the new one
+type connDeadline struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (d *connDeadline) init(parent context.Context) {
+	d.ctx, d.cancel = context.WithCancel(parent)
+}
+
+func (d *connDeadline) set(parent context.Context, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cancel()
+	if t.IsZero() {
+		d.ctx, d.cancel = context.WithCancel(parent)
+	} else {
+		d.ctx, d.cancel = context.WithDeadline(parent, t)
+	}
+}
+
+func (d *connDeadline) get() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.ctx
+}
+
+// NewConn limits the reads of c with read and the writes with write, nil means unlimited
+func NewConn(c net.Conn, read, write *TokenBucket) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &Conn{Conn: c, read: read, write: write, ctx: ctx, cancel: cancel}
+	conn.readWait.init(ctx)
+	conn.writeWait.init(ctx)
+	return conn
+}
+
+// Read reads at most a burst of bytes and then waits until they are paid for
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(p)
+	}
+
+	if burst := c.read.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.wait(c.read, &c.readWait, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Write writes p in chunks of at most a burst, each after waiting for its tokens
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if burst := c.write.Burst(); len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		if err := c.wait(c.write, &c.writeWait, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait takes n tokens of b, it starts over with the new deadline when the deadline changes
+func (c *Conn) wait(b *TokenBucket, d *connDeadline, n int) error {
+	for {
+		ctx := d.get()
+		err := b.WaitN(ctx, n)
+		switch {
+		case err == nil:
+			return nil
+		case c.ctx.Err() != nil:
+			return net.ErrClosed
+		case err == ErrLimitExceeded, err == context.DeadlineExceeded:
+			return os.ErrDeadlineExceeded
+		}
+		if d.get() == ctx {
+			return err
+		}
+	}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readWait.set(c.ctx, t)
+	c.writeWait.set(c.ctx, t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readWait.set(c.ctx, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeWait.set(c.ctx, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection and wakes up the reads and writes waiting for the buckets
+func (c *Conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
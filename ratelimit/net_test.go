@@ -0,0 +1,102 @@
+package ratelimiter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, NewFixedWindow(1, time.Hour))
+
+	go net.Dial("tcp", inner.Addr().String())
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, err := ln.Accept()
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ln.Close()
+	if err := <-errc; err != net.ErrClosed {
+		t.Fatalf("Accept after Close: %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// 10kB per second with bursts of 1kB: 3kB take about 200ms
+	c := NewConn(client, nil, NewTokenBucket(10000, time.Second, 1000))
+	go func() {
+		c.Write(make([]byte, 3000))
+		c.Close()
+	}()
+
+	start := time.Now()
+	data, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3000 {
+		t.Fatalf("read %d bytes, want 3000", len(data))
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("took %v, want about 200ms", d)
+	}
+}
+
+func TestConnDeadlineAndClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	// 10 bytes per second, the second chunk waits about 100s
+	c := NewConn(client, nil, NewTokenBucket(10, time.Second, 1000))
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write(make([]byte, 2000)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// a deadline set while waiting ends the wait
+	c.SetWriteDeadline(time.Time{})
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 1000))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write with a new deadline: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	c.SetWriteDeadline(time.Time{})
+	go func() {
+		_, err := c.Write(make([]byte, 1000))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Write after Close: %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not end the wait for the bucket")
+	}
+}
@@ -1,41 +1,69 @@
 package ratelimiter
 
 import (
+	"context"
 	"sync"
-
-	"go.uber.org/ratelimit"
+	"time"
 )
 
 var defaultrwmutex sync.RWMutex
-var defaultGlobalRateLimiter GlobalRateLimiter = GlobalRateLimiter{ratesLimiters: make(map[string]ratelimit.Limiter)}
+var defaultGlobalRateLimiter GlobalRateLimiter = GlobalRateLimiter{ratesLimiters: make(map[string]Limiter)}
 
 type GlobalRateLimiter struct {
 	sync.RWMutex
-	ratesLimiters map[string]ratelimit.Limiter
+	ratesLimiters map[string]Limiter
+}
+
+// newRateLimiter is the limiter of Add, rateLimit events per second evenly spaced
+func newRateLimiter(rateLimit int) Limiter {
+	if rateLimit > 0 {
+		return NewLeakyBucket(rateLimit, time.Second, 0)
+	}
+	return Unlimited
 }
 
 func Add(k string, rateLimit int) {
+	AddLimiter(k, newRateLimiter(rateLimit))
+}
+
+func AddLimiter(k string, l Limiter) {
 	defaultrwmutex.Lock()
 	defer defaultrwmutex.Unlock()
 
-	if rateLimit > 0 {
-		defaultGlobalRateLimiter.ratesLimiters[k] = ratelimit.New(rateLimit)
-	} else {
-		defaultGlobalRateLimiter.ratesLimiters[k] = ratelimit.NewUnlimited()
-	}
+	defaultGlobalRateLimiter.ratesLimiters[k] = l
+}
+
+// Take blocks until the limiter of k lets an event through, ErrKeyNotFound is returned for unknown keys
+func Take(k string) error {
+	return Wait(context.Background(), k)
 }
 
-func Take(k string) {
-	rl := take(k)
+func Wait(ctx context.Context, k string) error {
+	rl, err := Get(k)
+	if err != nil {
+		return err
+	}
+	return rl.Wait(ctx)
+}
 
-	rl.Take()
+// Allow reports whether an event for k may happen now without blocking
+func Allow(k string) (bool, error) {
+	rl, err := Get(k)
+	if err != nil {
+		return false, err
+	}
+	return rl.Allow(), nil
 }
 
-func take(k string) ratelimit.Limiter {
+func Get(k string) (Limiter, error) {
 	defaultrwmutex.RLock()
 	defer defaultrwmutex.RUnlock() //nolint
 
-	return defaultGlobalRateLimiter.ratesLimiters[k]
+	rl, ok := defaultGlobalRateLimiter.ratesLimiters[k]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return rl, nil
 }
 
 func Del(k string, rateLimit int) {
@@ -47,31 +75,52 @@ func Del(k string, rateLimit int) {
 
 func New() *GlobalRateLimiter {
 	var globalRateLimiter GlobalRateLimiter
-	globalRateLimiter.ratesLimiters = make(map[string]ratelimit.Limiter)
+	globalRateLimiter.ratesLimiters = make(map[string]Limiter)
 	return &globalRateLimiter
 }
 
 func (grl *GlobalRateLimiter) Add(k string, rateLimit int) {
+	grl.AddLimiter(k, newRateLimiter(rateLimit))
+}
+
+func (grl *GlobalRateLimiter) AddLimiter(k string, l Limiter) {
 	grl.Lock()
 	defer grl.Unlock()
 
-	if rateLimit > 0 {
-		grl.ratesLimiters[k] = ratelimit.New(rateLimit)
-	} else {
-		grl.ratesLimiters[k] = ratelimit.NewUnlimited()
-	}
+	grl.ratesLimiters[k] = l
 }
 
-func (grl *GlobalRateLimiter) take(k string) ratelimit.Limiter {
+func (grl *GlobalRateLimiter) Get(k string) (Limiter, error) {
 	grl.RLock()
 	defer grl.RUnlock() //nolint
 
-	return grl.ratesLimiters[k]
+	rl, ok := grl.ratesLimiters[k]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return rl, nil
 }
 
-func (grl *GlobalRateLimiter) Take(k string) {
-	rl := grl.take(k)
-	rl.Take()
+// Take blocks until the limiter of k lets an event through, ErrKeyNotFound is returned for unknown keys
+func (grl *GlobalRateLimiter) Take(k string) error {
+	return grl.Wait(context.Background(), k)
+}
+
+func (grl *GlobalRateLimiter) Wait(ctx context.Context, k string) error {
+	rl, err := grl.Get(k)
+	if err != nil {
+		return err
+	}
+	return rl.Wait(ctx)
+}
+
+// Allow reports whether an event for k may happen now without blocking
+func (grl *GlobalRateLimiter) Allow(k string) (bool, error) {
+	rl, err := grl.Get(k)
+	if err != nil {
+		return false, err
+	}
+	return rl.Allow(), nil
 }
 
 func (grl *GlobalRateLimiter) Del(k string, rateLimit int) {
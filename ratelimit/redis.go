@@ -0,0 +1,383 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRedisProtocol = errors.New("ratelimit: redis protocol error")
+)
+
+// RedisError is an error reply of the server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore is a Store speaking the Redis protocol, it works with any RESP2 compatible server.
+//
+// IncrBy is a MULTI of SET NX PX, INCRBY and PTTL, CompareAndSwap a WATCH, GET and MULTI of SET PX.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	dialer   net.Dialer
+	idle     chan *redisConn
+}
+
+type RedisOption func(s *RedisStore)
+
+func WithRedisPassword(password string) RedisOption {
+	return func(s *RedisStore) {
+		s.password = password
+	}
+}
+
+func WithRedisDB(db int) RedisOption {
+	return func(s *RedisStore) {
+		s.db = db
+	}
+}
+
+// WithRedisPoolSize sets how many idle connections are kept, default 8
+func WithRedisPoolSize(n int) RedisOption {
+	return func(s *RedisStore) {
+		if n > 0 {
+			s.idle = make(chan *redisConn, n)
+		}
+	}
+}
+
+// WithRedisTimeout bounds dialing and every command without a context deadline, default 1s
+func WithRedisTimeout(d time.Duration) RedisOption {
+	return func(s *RedisStore) {
+		s.timeout = d
+	}
+}
+
+func NewRedisStore(addr string, opts ...RedisOption) *RedisStore {
+	s := &RedisStore{
+		addr:    addr,
+		timeout: time.Second,
+		idle:    make(chan *redisConn, 8),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *RedisStore) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, time.Duration, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	replies, err := c.pipeline(
+		[]interface{}{"MULTI"},
+		[]interface{}{"SET", key, 0, "PX", millis(ttl), "NX"},
+		[]interface{}{"INCRBY", key, n},
+		[]interface{}{"PTTL", key},
+		[]interface{}{"EXEC"},
+	)
+	s.put(c, err)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	exec, ok := replies[4].([]interface{})
+	if !ok || len(exec) != 3 {
+		return 0, 0, ErrRedisProtocol
+	}
+	value, ok1 := exec[1].(int64)
+	pttl, ok2 := exec[2].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, ErrRedisProtocol
+	}
+	return value, time.Duration(pttl) * time.Millisecond, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	replies, err := c.pipeline([]interface{}{"GET", key})
+	s.put(c, err)
+	if err != nil {
+		return 0, err
+	}
+	return parseInt(replies[0])
+}
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	swapped, err := c.compareAndSwap(key, old, new, ttl)
+	s.put(c, err)
+	return swapped, err
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// conn returns an idle connection or dials a new one, its deadline is taken from ctx
+func (s *RedisStore) conn(ctx context.Context) (*redisConn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.timeout)
+	}
+
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		dctx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+
+		conn, err := s.dialer.DialContext(dctx, "tcp", s.addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+		if err := c.SetDeadline(deadline); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if err := s.handshake(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if err := c.SetDeadline(deadline); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *RedisStore) handshake(c *redisConn) error {
+	var cmds [][]interface{}
+	if s.password != "" {
+		cmds = append(cmds, []interface{}{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []interface{}{"SELECT", s.db})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	replies, err := c.pipeline(cmds...)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(RedisError); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// put returns c to the pool, unless err tells the connection may be out of sync
+func (s *RedisStore) put(c *redisConn, err error) {
+	if err != nil {
+		if _, ok := err.(RedisError); !ok {
+			c.Close()
+			return
+		}
+	}
+
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// pipeline sends all cmds at once and reads their replies, the first error reply is returned as error
+func (c *redisConn) pipeline(cmds ...[]interface{}) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		if err := c.write(cmd); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if rerr, ok := reply.(RedisError); ok && firstErr == nil {
+			firstErr = rerr
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+func (c *redisConn) compareAndSwap(key string, old, new int64, ttl time.Duration) (swapped bool, err error) {
+	defer func() {
+		// an error reply must not leave the key watched on a pooled connection
+		if _, ok := err.(RedisError); ok {
+			c.pipeline([]interface{}{"UNWATCH"})
+		}
+	}()
+
+	replies, err := c.pipeline(
+		[]interface{}{"WATCH", key},
+		[]interface{}{"GET", key},
+	)
+	if err != nil {
+		return false, err
+	}
+	cur, err := parseInt(replies[1])
+	if err != nil {
+		return false, err
+	}
+	if cur != old {
+		_, err := c.pipeline([]interface{}{"UNWATCH"})
+		return false, err
+	}
+
+	replies, err = c.pipeline(
+		[]interface{}{"MULTI"},
+		[]interface{}{"SET", key, new, "PX", millis(ttl)},
+		[]interface{}{"EXEC"},
+	)
+	if err != nil {
+		return false, err
+	}
+	// EXEC replies a null array when the watched key changed meanwhile
+	return replies[2] != nil, nil
+}
+
+func (c *redisConn) write(args []interface{}) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			s = fmt.Sprint(v)
+		}
+		if _, err := fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(s), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read returns one reply: string, RedisError, int64, []byte, []interface{} or nil
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, ErrRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, ErrRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, ErrRedisProtocol
+	}
+}
+
+// parseInt reads a bulk string reply as int64, nil is 0
+func parseInt(reply interface{}) (int64, error) {
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case int64:
+		return v, nil
+	default:
+		return 0, ErrRedisProtocol
+	}
+}
+
+// millis rounds d up to whole milliseconds, redis rejects an expiry of 0
+func millis(d time.Duration) int64 {
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
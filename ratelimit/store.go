@@ -0,0 +1,103 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store keeps the counters shared by the replicas of a distributed limiter.
+// Values are int64, a missing or expired key reads as 0.
+type Store interface {
+	// IncrBy atomically adds n to key and returns the new value and the remaining ttl,
+	// ttl is only set when the key is created
+	IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, time.Duration, error)
+	// Get returns the value of key
+	Get(ctx context.Context, key string) (int64, error)
+	// CompareAndSwap sets key to new expiring after ttl if its value is still old
+	CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error)
+}
+
+// MemoryStore is a Store inside the process, for tests and single replica setups
+type MemoryStore struct {
+	mu      sync.Mutex
+	clock   Clock
+	entries map[string]memoryEntry
+	sweepAt int
+}
+
+type memoryEntry struct {
+	value   int64
+	expires time.Time
+}
+
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	c := newConfig(opts)
+	return &MemoryStore{
+		clock:   c.clock,
+		entries: make(map[string]memoryEntry),
+		sweepAt: 64,
+	}
+}
+
+func (s *MemoryStore) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	e, ok := s.lookup(key, now)
+	if !ok {
+		e.expires = now.Add(ttl)
+	}
+	e.value += n
+	s.store(key, e, now)
+	return e.value, e.expires.Sub(now), nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, _ := s.lookup(key, s.clock.Now())
+	return e.value, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	if e, _ := s.lookup(key, now); e.value != old {
+		return false, nil
+	}
+	s.store(key, memoryEntry{value: new, expires: now.Add(ttl)}, now)
+	return true, nil
+}
+
+// lookup returns the live entry of key, the lock must be held
+func (s *MemoryStore) lookup(key string, now time.Time) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return memoryEntry{}, false
+	}
+	if !now.Before(e.expires) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, true
+}
+
+// store saves e and drops the expired entries whenever the map doubled, the lock must be held
+func (s *MemoryStore) store(key string, e memoryEntry, now time.Time) {
+	s.entries[key] = e
+	if len(s.entries) < s.sweepAt {
+		return
+	}
+
+	for k, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.sweepAt = 2*len(s.entries) + 64
+}
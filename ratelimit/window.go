@@ -0,0 +1,210 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FixedWindow allows limit events per window aligned on the clock, e.g. per wall clock minute.
+// Up to twice the limit may pass around a window boundary.
+type FixedWindow struct {
+	mu     sync.Mutex
+	clock  Clock
+	limit  int
+	window time.Duration
+	start  time.Time
+	count  int
+}
+
+func NewFixedWindow(limit int, window time.Duration, opts ...Option) *FixedWindow {
+	c := newConfig(opts)
+	return &FixedWindow{
+		clock:  c.clock,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (w *FixedWindow) Allow() bool {
+	return allow(w)
+}
+
+func (w *FixedWindow) Wait(ctx context.Context) error {
+	return wait(ctx, w)
+}
+
+func (w *FixedWindow) Reserve() *Reservation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	if start := now.Truncate(w.window); !start.Equal(w.start) {
+		w.start = start
+		w.count = 0
+	}
+
+	if w.count >= w.limit {
+		return &Reservation{delay: w.start.Add(w.window).Sub(now)}
+	}
+
+	w.count++
+	start := w.start
+	return &Reservation{ok: true, cancel: func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if w.start.Equal(start) && w.count > 0 {
+			w.count--
+		}
+	}}
+}
+
+// SlidingLog remembers the time of every event of the last window,
+// it is exact at the cost of memory proportional to the limit.
+type SlidingLog struct {
+	mu     sync.Mutex
+	clock  Clock
+	limit  int
+	window time.Duration
+	log    []time.Time // ring buffer of event times, oldest at head
+	head   int
+	size   int
+}
+
+func NewSlidingLog(limit int, window time.Duration, opts ...Option) *SlidingLog {
+	c := newConfig(opts)
+	if limit < 0 {
+		limit = 0
+	}
+	return &SlidingLog{
+		clock:  c.clock,
+		limit:  limit,
+		window: window,
+		log:    make([]time.Time, limit),
+	}
+}
+
+func (l *SlidingLog) Allow() bool {
+	return allow(l)
+}
+
+func (l *SlidingLog) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+func (l *SlidingLog) Reserve() *Reservation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	boundary := now.Add(-l.window)
+	for l.size > 0 && !l.log[l.head].After(boundary) {
+		l.head = (l.head + 1) % l.limit
+		l.size--
+	}
+
+	if l.limit == 0 {
+		return &Reservation{delay: l.window}
+	}
+	if l.size >= l.limit {
+		return &Reservation{delay: l.log[l.head].Sub(boundary)}
+	}
+
+	l.log[(l.head+l.size)%l.limit] = now
+	l.size++
+	return &Reservation{ok: true, cancel: func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// events are only appended, the newest one with this time is the booked one
+		if l.size > 0 && l.log[(l.head+l.size-1)%l.limit].Equal(now) {
+			l.size--
+		}
+	}}
+}
+
+// SlidingWindowCounter estimates the events of the last window from the counts
+// of the current and the previous fixed windows, with constant memory.
+type SlidingWindowCounter struct {
+	mu     sync.Mutex
+	clock  Clock
+	limit  int
+	window time.Duration
+	start  time.Time
+	cur    int
+	prev   int
+}
+
+func NewSlidingWindowCounter(limit int, window time.Duration, opts ...Option) *SlidingWindowCounter {
+	c := newConfig(opts)
+	return &SlidingWindowCounter{
+		clock:  c.clock,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (w *SlidingWindowCounter) Allow() bool {
+	return allow(w)
+}
+
+func (w *SlidingWindowCounter) Wait(ctx context.Context) error {
+	return wait(ctx, w)
+}
+
+func (w *SlidingWindowCounter) Reserve() *Reservation {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.clock.Now()
+	if start := now.Truncate(w.window); !start.Equal(w.start) {
+		if start.Sub(w.start) == w.window {
+			w.prev = w.cur
+		} else {
+			w.prev = 0
+		}
+		w.start = start
+		w.cur = 0
+	}
+
+	elapsed := now.Sub(w.start)
+	weight := float64(w.window-elapsed) / float64(w.window)
+	if float64(w.prev)*weight+float64(w.cur) >= float64(w.limit) {
+		return &Reservation{delay: w.retryAfter(elapsed)}
+	}
+
+	w.cur++
+	start := w.start
+	return &Reservation{ok: true, cancel: func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if w.start.Equal(start) && w.cur > 0 {
+			w.cur--
+		}
+	}}
+}
+
+// retryAfter is when the estimate drops below the limit if no other event happens
+func (w *SlidingWindowCounter) retryAfter(elapsed time.Duration) time.Duration {
+	window := float64(w.window)
+	if w.cur < w.limit && w.prev > 0 {
+		// prev*(window-e)/window + cur < limit
+		e := window * (1 - float64(w.limit-w.cur)/float64(w.prev))
+		if d := time.Duration(e) - elapsed + 1; d > 0 {
+			return d
+		}
+		return 1
+	}
+	if w.cur == 0 || w.limit <= 0 {
+		return w.window - elapsed
+	}
+
+	// in the next window: cur*(window-e)/window < limit
+	e := window * (1 - float64(w.limit)/float64(w.cur))
+	if e < 0 {
+		e = 0
+	}
+	return w.window - elapsed + time.Duration(e) + 1
+}
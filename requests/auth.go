@@ -0,0 +1,169 @@
+package requests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoAccessToken = errors.New("requests: token response has no access_token")
+
+// TokenSource returns the token of the Authorization header
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a token that never changes
+type StaticToken string
+
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// Bearer sends the token of ts as bearer token with requests that carry no Authorization yet.
+// A 401 response makes a source with an Invalidate method drop its token and the request
+// is sent once more with a fresh one when its body can be sent again.
+func Bearer(ts TokenSource) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Authorization") != "" {
+				return next.RoundTrip(req)
+			}
+
+			send := func(req *http.Request) (*http.Response, error) {
+				token, err := ts.Token(req.Context())
+				if err != nil {
+					return nil, err
+				}
+				req = req.Clone(req.Context())
+				req.Header.Set("Authorization", "Bearer "+token)
+				return next.RoundTrip(req)
+			}
+
+			resp, err := send(req)
+			inv, ok := ts.(interface{ Invalidate() })
+			if err != nil || resp.StatusCode != http.StatusUnauthorized || !ok {
+				return resp, err
+			}
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return resp, nil
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					return resp, nil
+				}
+				req = req.Clone(req.Context())
+				req.Body = body
+			}
+
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			inv.Invalidate()
+			return send(req)
+		})
+	}
+}
+
+// ClientCredentials fetches tokens with the OAuth2 client credentials grant of RFC 6749
+// and keeps them until shortly before they expire
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Client fetches the tokens, default a client with a timeout of 10s
+	Client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// expiryDelta is how long before its expiry a token is refreshed
+const expiryDelta = 30 * time.Second
+
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.expiry.IsZero() || time.Now().Add(expiryDelta).Before(c.expiry)) {
+		return c.token, nil
+	}
+
+	token, expiresIn, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expiry = token, time.Time{}
+	if expiresIn > 0 {
+		c.expiry = time.Now().Add(expiresIn)
+	}
+	return c.token, nil
+}
+
+// Invalidate drops the token, the next request fetches a new one
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.expiry = "", time.Time{}
+}
+
+func (c *ClientCredentials) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Transport: defaultClient.Transport, Timeout: 10 * time.Second}
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", 0, &HTTPError{
+			Method:     req.Method,
+			URL:        c.TokenURL,
+			StatusCode: rsp.StatusCode,
+			Status:     rsp.Status,
+			Header:     rsp.Header,
+			Body:       body,
+		}
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("requests: decoding token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, ErrNoAccessToken
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
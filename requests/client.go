@@ -0,0 +1,277 @@
+package requests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HTTPError is returned for responses with a status other than 2xx, the response is returned along
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	body := e.Body
+	if len(body) > 256 {
+		body = body[:256]
+	}
+	if len(body) == 0 {
+		return fmt.Sprintf("requests: %s %s: %s", e.Method, e.URL, e.Status)
+	}
+	return fmt.Sprintf("requests: %s %s: %s: %s", e.Method, e.URL, e.Status, body)
+}
+
+type ClientOption func(c *Client)
+
+// WithBaseURL makes relative request urls relative to base
+func WithBaseURL(base string) ClientOption {
+	return func(c *Client) {
+		c.baseURL = base
+	}
+}
+
+// WithHeader sets a header sent with every request
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		c.header.Set(key, value)
+	}
+}
+
+// WithTimeout bounds every request including reading the body, 0 means no limit
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithHTTPClient sends the requests with hc, its Timeout still applies
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.client = hc
+	}
+}
+
+// Client sends requests built with R
+type Client struct {
+	client      *http.Client
+	baseURL     string
+	header      http.Header
+	timeout     time.Duration
+	middlewares []Middleware
+}
+
+// NewClient returns a client with a timeout of 30s over the transport of the package funcs
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		client:  &http.Client{Transport: defaultClient.Transport},
+		header:  make(http.Header),
+		timeout: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if len(c.middlewares) > 0 {
+		hc := *c.client
+		hc.Transport = Chain(hc.Transport, c.middlewares...)
+		c.client = &hc
+	}
+	return c
+}
+
+// R starts a request
+func (c *Client) R() *RequestBuilder {
+	return &RequestBuilder{
+		client:  c,
+		ctx:     context.Background(),
+		header:  c.header.Clone(),
+		query:   make(url.Values),
+		timeout: c.timeout,
+	}
+}
+
+// RequestBuilder collects a request until one of its method funcs sends it
+type RequestBuilder struct {
+	client  *Client
+	ctx     context.Context
+	header  http.Header
+	query   url.Values
+	body    []byte
+	timeout time.Duration
+	err     error
+}
+
+func (b *RequestBuilder) WithContext(ctx context.Context) *RequestBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// SetTimeout overrides the timeout of the client for this request
+func (b *RequestBuilder) SetTimeout(d time.Duration) *RequestBuilder {
+	b.timeout = d
+	return b
+}
+
+func (b *RequestBuilder) SetHeader(key, value string) *RequestBuilder {
+	b.header.Set(key, value)
+	return b
+}
+
+func (b *RequestBuilder) SetHeaders(header map[string]string) *RequestBuilder {
+	for k, v := range header {
+		b.header.Set(k, v)
+	}
+	return b
+}
+
+func (b *RequestBuilder) SetQuery(key, value string) *RequestBuilder {
+	b.query.Set(key, value)
+	return b
+}
+
+func (b *RequestBuilder) SetQueryParams(params map[string]string) *RequestBuilder {
+	for k, v := range params {
+		b.query.Set(k, v)
+	}
+	return b
+}
+
+func (b *RequestBuilder) SetBasicAuth(user, password string) *RequestBuilder {
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	b.header.Set("Authorization", "Basic "+auth)
+	return b
+}
+
+// SetBody sends body as is, set the Content-Type along
+func (b *RequestBuilder) SetBody(body []byte) *RequestBuilder {
+	b.body = body
+	return b
+}
+
+// SetJSON sends v encoded as JSON
+func (b *RequestBuilder) SetJSON(v interface{}) *RequestBuilder {
+	b.body, b.err = json.Marshal(v)
+	b.header.Set("Content-Type", "application/json")
+	return b
+}
+
+// SetForm sends the params url encoded
+func (b *RequestBuilder) SetForm(params map[string]string) *RequestBuilder {
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	b.body = []byte(form.Encode())
+	b.header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b
+}
+
+func (b *RequestBuilder) Get(url string) (*Response, error) {
+	return b.Do(MethodGet, url)
+}
+
+func (b *RequestBuilder) Post(url string) (*Response, error) {
+	return b.Do(MethodPost, url)
+}
+
+func (b *RequestBuilder) Put(url string) (*Response, error) {
+	return b.Do(MethodPut, url)
+}
+
+func (b *RequestBuilder) Patch(url string) (*Response, error) {
+	return b.Do(MethodPatch, url)
+}
+
+func (b *RequestBuilder) Delete(url string) (*Response, error) {
+	return b.Do(MethodDelete, url)
+}
+
+// Do sends the request, a status other than 2xx returns the response and an *HTTPError
+func (b *RequestBuilder) Do(method, rawURL string) (*Response, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	u, err := url.Parse(b.client.resolve(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	if len(b.query) > 0 {
+		query := u.Query()
+		for k, vs := range b.query {
+			query[k] = vs
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	ctx, cancel := b.ctx, context.CancelFunc(func() {})
+	if b.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+	}
+	defer cancel()
+
+	var body io.Reader
+	if b.body != nil {
+		body = bytes.NewReader(b.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = b.header.Clone()
+	return b.client.do(req)
+}
+
+// resolve joins relative urls to the base url
+func (c *Client) resolve(rawURL string) string {
+	if c.baseURL == "" || strings.Contains(rawURL, "://") {
+		return rawURL
+	}
+	return strings.TrimRight(c.baseURL, "/") + "/" + strings.TrimLeft(rawURL, "/")
+}
+
+func (c *Client) do(req *http.Request) (*Response, error) {
+	start := time.Now()
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+
+		if debugMode {
+			log.Printf("call rpc [%s] %s in %v \n", req.Method, req.URL, time.Since(start))
+		}
+	}()
+
+	r, err := buildResponse(rsp)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return r, &HTTPError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: rsp.StatusCode,
+			Status:     rsp.Status,
+			Header:     rsp.Header,
+			Body:       r.Body,
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,282 @@
+package requests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rfyiamcool/golib/retry"
+	timingStats "github.com/rfyiamcool/golib/timing_bucket_stats"
+)
+
+// RoundTripperFunc adapts a func to http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware wraps the round trip of a request
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// Chain wraps rt with mws, the first middleware sees the request first
+func Chain(rt http.RoundTripper, mws ...Middleware) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	for i := len(mws) - 1; i >= 0; i-- {
+		rt = mws[i](rt)
+	}
+	return rt
+}
+
+// WithMiddleware wraps the transport of the client with mws
+func WithMiddleware(mws ...Middleware) ClientOption {
+	return func(c *Client) {
+		c.middlewares = append(c.middlewares, mws...)
+	}
+}
+
+// Use wraps the transport of the package funcs with mws
+func Use(mws ...Middleware) {
+	defaultClient.Transport = Chain(defaultClient.Transport, mws...)
+}
+
+type retryConfig struct {
+	times         int
+	backoff       retry.Backoff
+	maxRetryAfter time.Duration
+	statuses      map[int]bool
+}
+
+type RetryOption func(c *retryConfig)
+
+// WithRetryTimes sets how often a request is retried at most, default 3
+func WithRetryTimes(times int) RetryOption {
+	return func(c *retryConfig) {
+		c.times = times
+	}
+}
+
+// WithRetryBackoff sets the delays between the tries, default from 100ms doubling up to 5s with jitter
+func WithRetryBackoff(bo retry.Backoff) RetryOption {
+	return func(c *retryConfig) {
+		c.backoff = bo
+	}
+}
+
+// WithMaxRetryAfter caps how long a Retry-After header makes the retry wait, default 30s,
+// a longer one returns the response instead
+func WithMaxRetryAfter(d time.Duration) RetryOption {
+	return func(c *retryConfig) {
+		c.maxRetryAfter = d
+	}
+}
+
+// WithRetryStatuses sets the statuses that are retried, default 429, 502, 503 and 504
+func WithRetryStatuses(statuses ...int) RetryOption {
+	return func(c *retryConfig) {
+		c.statuses = make(map[int]bool)
+		for _, status := range statuses {
+			c.statuses[status] = true
+		}
+	}
+}
+
+// Retry retries idempotent requests, and those with an Idempotency-Key header, that failed
+// to connect or got a retriable status. The delay grows with the backoff of the retry package
+// but is at least what the Retry-After header of the response asks for.
+func Retry(opts ...RetryOption) Middleware {
+	c := &retryConfig{
+		times:         3,
+		backoff:       retry.Backoff{MinDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second, Factor: 2, Jitter: true},
+		maxRetryAfter: 30 * time.Second,
+	}
+	WithRetryStatuses(http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout)(c)
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !retriable(req) {
+				return next.RoundTrip(req)
+			}
+
+			bo := c.backoff
+			for attempt := 0; ; attempt++ {
+				try := req
+				if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					try = req.Clone(req.Context())
+					try.Body = body
+				}
+
+				resp, err := next.RoundTrip(try)
+				if attempt >= c.times || req.Context().Err() != nil {
+					return resp, err
+				}
+
+				delay := bo.Duration()
+				if err == nil {
+					if !c.statuses[resp.StatusCode] {
+						return resp, nil
+					}
+					wait, ok := retryAfter(resp.Header.Get("Retry-After"))
+					if ok && wait > c.maxRetryAfter {
+						return resp, nil
+					}
+					if wait > delay {
+						delay = wait
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+
+				if err := sleep(req.Context(), delay); err != nil {
+					return nil, err
+				}
+			}
+		})
+	}
+}
+
+// retriable reports whether sending req twice does no harm and its body can be sent again
+func retriable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// retryAfter parses the seconds or the date of a Retry-After header
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Gzip compresses request bodies of at least minSize bytes that are not encoded yet
+func Gzip(minSize int) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+				return next.RoundTrip(req)
+			}
+			if req.ContentLength >= 0 && req.ContentLength < int64(minSize) {
+				return next.RoundTrip(req)
+			}
+
+			data, err := io.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+
+			compressed := buf.Bytes()
+			req = req.Clone(req.Context())
+			req.Header.Set("Content-Encoding", "gzip")
+			req.ContentLength = int64(len(compressed))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(compressed)), nil
+			}
+			req.Body, _ = req.GetBody()
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// HostLatency keeps the latency of the last 60 seconds per host
+type HostLatency struct {
+	mu    sync.RWMutex
+	hosts map[string]*timingStats.Timing
+}
+
+func NewHostLatency() *HostLatency {
+	return &HostLatency{hosts: make(map[string]*timingStats.Timing)}
+}
+
+func (h *HostLatency) Add(host string, d time.Duration) {
+	h.mu.RLock()
+	t, ok := h.hosts[host]
+	h.mu.RUnlock()
+
+	if !ok {
+		h.mu.Lock()
+		if t, ok = h.hosts[host]; !ok {
+			t = timingStats.NewTiming()
+			h.hosts[host] = t
+		}
+		h.mu.Unlock()
+	}
+	t.Add(d)
+}
+
+// Timing returns the timing of host, nil before its first request
+func (h *HostLatency) Timing(host string) *timingStats.Timing {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.hosts[host]
+}
+
+// Hosts returns the hosts with timings in order
+func (h *HostLatency) Hosts() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Latency records how long every round trip to a host took until the response header, failed ones too
+func Latency(h *HostLatency) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			h.Add(req.URL.Host, time.Since(start))
+			return resp, err
+		})
+	}
+}
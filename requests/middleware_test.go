@@ -0,0 +1,223 @@
+package requests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rfyiamcool/golib/retry"
+)
+
+var fastBackoff = retry.Backoff{MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Factor: 2}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	layer := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	rt := Chain(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		order = append(order, "transport")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}), layer("a"), layer("b"))
+
+	req, _ := http.NewRequest(MethodGet, "http://example.org", nil)
+	rt.RoundTrip(req)
+	if got := strings.Join(order, ","); got != "a,b,transport" {
+		t.Fatalf("order: %s", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch n := atomic.AddInt32(&calls, 1); {
+		case n == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case n == 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(body)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithMiddleware(Retry(WithRetryBackoff(fastBackoff))))
+	start := time.Now()
+	resp, err := c.R().SetBody([]byte("payload")).Put(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.String() != "payload" || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("response: %q after %d calls", resp.String(), calls)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("took %v, want Retry-After honoured", elapsed)
+	}
+
+	// posts are not idempotent
+	atomic.StoreInt32(&calls, 1)
+	_, err = c.R().Post(srv.URL)
+	var herr *HTTPError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("post: %v", err)
+	}
+
+	// unless they carry an idempotency key
+	atomic.StoreInt32(&calls, 1)
+	if _, err = c.R().SetHeader("Idempotency-Key", "k1").Post(srv.URL); err != nil {
+		t.Fatalf("post with key: %v", err)
+	}
+}
+
+func TestRetryLimits(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/later" {
+			w.Header().Set("Retry-After", "3600")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithMiddleware(Retry(WithRetryTimes(2), WithRetryBackoff(fastBackoff))))
+	if _, err := c.R().Get(srv.URL); err == nil || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("err: %v after %d calls, want 3 calls", err, calls)
+	}
+
+	// a Retry-After beyond the cap returns the response right away
+	atomic.StoreInt32(&calls, 0)
+	resp, _ := c.R().Get(srv.URL + "/later")
+	if resp == nil || resp.StatusCode != http.StatusBadGateway || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("response: %v after %d calls", resp, calls)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	var fetched int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		r.ParseForm()
+		if user != "id" || pass != "secret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != "read write" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&fetched, 1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"t`+string('0'+n)+`","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	var revoked atomic.Value
+	revoked.Store("")
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth == "Bearer "+revoked.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, auth)
+	}))
+	defer api.Close()
+
+	cc := &ClientCredentials{TokenURL: tokenSrv.URL, ClientID: "id", ClientSecret: "secret", Scopes: []string{"read", "write"}}
+	c := NewClient(WithMiddleware(Bearer(cc)))
+	for i := 0; i < 2; i++ {
+		resp, err := c.R().Get(api.URL)
+		if err != nil || resp.String() != "Bearer t1" {
+			t.Fatalf("request %d: %v, %v", i, resp, err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Fatalf("fetched %d tokens, want the first one kept", n)
+	}
+
+	// a rejected token is refreshed once
+	revoked.Store("t1")
+	resp, err := c.R().SetBody([]byte("x")).Put(api.URL)
+	if err != nil || resp.String() != "Bearer t2" {
+		t.Fatalf("after 401: %v, %v", resp, err)
+	}
+
+	bad := &ClientCredentials{TokenURL: tokenSrv.URL, ClientID: "id", ClientSecret: "wrong"}
+	var herr *HTTPError
+	if _, err := NewClient(WithMiddleware(Bearer(bad))).R().Get(api.URL); !errors.As(err, &herr) {
+		t.Fatalf("bad credentials: %v, want *HTTPError", err)
+	}
+
+	resp, err = NewClient(WithMiddleware(Bearer(StaticToken("static")))).R().Get(api.URL)
+	if err != nil || resp.String() != "Bearer static" {
+		t.Fatalf("static: %v, %v", resp, err)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+			w.Header().Set("X-Gzip", "1")
+		}
+		io.Copy(w, body)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithMiddleware(Gzip(16)))
+	large := bytes.Repeat([]byte("a"), 1024)
+	resp, err := c.R().SetBody(large).Post(srv.URL)
+	if err != nil || !bytes.Equal(resp.Body, large) || resp.Header["X-Gzip"] == nil {
+		t.Fatalf("large body: %v", err)
+	}
+
+	resp, err = c.R().SetBody([]byte("small")).Post(srv.URL)
+	if err != nil || resp.String() != "small" || resp.Header["X-Gzip"] != nil {
+		t.Fatalf("small body: %v, %v", resp, err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	h := NewHostLatency()
+	c := NewClient(WithMiddleware(Latency(h)))
+	for i := 0; i < 3; i++ {
+		if _, err := c.R().Get(srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, _ := url.Parse(srv.URL)
+	if hosts := h.Hosts(); len(hosts) != 1 || hosts[0] != u.Host {
+		t.Fatalf("hosts: %v", hosts)
+	}
+	timing := h.Timing(u.Host)
+	if n := len(timing.SortedDurations()); n != 3 {
+		t.Fatalf("durations: %d, want 3", n)
+	}
+	if p := timing.Percentile(50); p < 20 {
+		t.Fatalf("p50: %dms, want at least 20ms", p)
+	}
+}
@@ -2,6 +2,8 @@ package requests
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,6 +27,7 @@ const (
 
 var (
 	defaultClient *http.Client
+	std           *Client
 
 	debugMode = false
 )
@@ -43,6 +46,7 @@ func init() {
 		Transport: tr,
 		Timeout:   time.Second * 30,
 	}
+	std = &Client{client: defaultClient, header: make(http.Header)}
 }
 
 // Request request info
@@ -72,6 +76,15 @@ type Response struct {
 	Body       []byte
 }
 
+// DecodeJSON unmarshals the body into out
+func (r *Response) DecodeJSON(out interface{}) error {
+	return json.Unmarshal(r.Body, out)
+}
+
+func (r *Response) String() string {
+	return string(r.Body)
+}
+
 func AddParameters(baseURL string, queryParams map[string]string) string {
 	baseURL += "?"
 	params := url.Values{}
@@ -88,8 +101,9 @@ func BuildHTTPRequest(request *Request) (*http.Request, error) {
 		body    io.Reader
 	)
 
-	// handle parameters
-	if request.Method == MethodPost {
+	// handle parameters, a post without body sends them as form
+	form := request.Method == MethodPost && len(request.Body) == 0
+	if form {
 		args := url.Values{}
 		for k, v := range request.Params {
 			args.Set(k, v)
@@ -122,7 +136,7 @@ func BuildHTTPRequest(request *Request) (*http.Request, error) {
 
 	// default type
 	_, ok := request.Header["Content-Type"]
-	if len(request.Body) > 0 && !ok {
+	if (form || len(request.Body) > 0) && !ok {
 		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
 
@@ -143,50 +157,38 @@ func buildResponse(res *http.Response) (*Response, error) {
 	return r, nil
 }
 
-// Send send http request
+// Send send http request, a status other than 2xx returns the response and an *HTTPError
 func Send(request *Request) (*Response, error) {
-	var start = time.Now()
+	return SendContext(context.Background(), request)
+}
 
+// SendContext is Send with a context
+func SendContext(ctx context.Context, request *Request) (*Response, error) {
 	// build http request
 	httpReq, err := BuildHTTPRequest(request)
 	if err != nil {
 		return nil, err
 	}
 
-	// send http request
-	rsp, err := defaultClient.Do(httpReq)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func() {
-		io.Copy(ioutil.Discard, rsp.Body)
-		// close http response
-		rsp.Body.Close()
-
-		if debugMode {
-			log.Printf("call rpc [%s] %s in %v \n", httpReq.Method, httpReq.URL, time.Since(start))
-		}
-	}()
-
-	// build response
-	r, err := buildResponse(rsp)
-	return r, err
+	return std.do(httpReq.WithContext(ctx))
 }
 
-func makeJsonHeader(header map[string]string) {
+func makeJsonHeader(header map[string]string) map[string]string {
+	if header == nil {
+		header = make(map[string]string)
+	}
 	header["Content-Type"] = "application/json"
+	return header
 }
 
 func PostBody(url string, header map[string]string, data []byte) (*Response, error) {
-	req := NewRequest(url, MethodGet, header, nil, data)
-	makeJsonHeader(req.Header)
+	req := NewRequest(url, MethodPost, makeJsonHeader(header), nil, data)
 	resp, err := Send(req)
 	return resp, err
 }
 
 func Post(api string, header map[string]string, params map[string]string) (*Response, error) {
-	req := NewRequest(api, MethodGet, header, params, nil)
+	req := NewRequest(api, MethodPost, header, params, nil)
 	resp, err := Send(req)
 	return resp, err
 }
@@ -1 +1,166 @@
 package requests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type echo struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Query  string            `json:"query"`
+	Header map[string]string `json:"header"`
+	Body   string            `json:"body"`
+}
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.Error(w, "no such thing", http.StatusNotFound)
+			return
+		case "/slow":
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		e := echo{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: map[string]string{
+				"Content-Type":  r.Header.Get("Content-Type"),
+				"Authorization": r.Header.Get("Authorization"),
+				"X-Team":        r.Header.Get("X-Team"),
+			},
+			Body: string(body),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPost(t *testing.T) {
+	srv := newEchoServer(t)
+
+	resp, err := Post(srv.URL+"/form", nil, map[string]string{"a": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e echo
+	if err := resp.DecodeJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Method != MethodPost || e.Body != "a=1" || e.Header["Content-Type"] != "application/x-www-form-urlencoded" {
+		t.Fatalf("Post: %+v", e)
+	}
+
+	// a nil header does not panic
+	resp, err = PostBody(srv.URL+"/json", nil, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = echo{}
+	resp.DecodeJSON(&e)
+	if e.Method != MethodPost || e.Body != `{"a":1}` || e.Header["Content-Type"] != "application/json" {
+		t.Fatalf("PostBody: %+v", e)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := newEchoServer(t)
+	c := NewClient(WithBaseURL(srv.URL+"/api/"), WithHeader("X-Team", "infra"))
+
+	resp, err := c.R().
+		WithContext(context.Background()).
+		SetQuery("page", "2").
+		SetBasicAuth("user", "secret").
+		SetJSON(map[string]int{"n": 1}).
+		Put("/items/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e echo
+	if err := resp.DecodeJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	want := echo{
+		Method: MethodPut,
+		Path:   "/api/items/7",
+		Query:  "page=2",
+		Header: map[string]string{
+			"Content-Type":  "application/json",
+			"Authorization": "Basic dXNlcjpzZWNyZXQ=",
+			"X-Team":        "infra",
+		},
+		Body: `{"n":1}`,
+	}
+	if e.Method != want.Method || e.Path != want.Path || e.Query != want.Query || e.Body != want.Body {
+		t.Fatalf("request: %+v, want %+v", e, want)
+	}
+	for k, v := range want.Header {
+		if e.Header[k] != v {
+			t.Fatalf("header %s: %q, want %q", k, e.Header[k], v)
+		}
+	}
+
+	// absolute urls ignore the base url
+	resp, err = c.R().Get(srv.URL + "/other")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("absolute url: %v, %v", resp, err)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	srv := newEchoServer(t)
+
+	resp, err := NewClient().R().Get(srv.URL + "/missing")
+	var herr *HTTPError
+	if !errors.As(err, &herr) {
+		t.Fatalf("err: %v, want *HTTPError", err)
+	}
+	if herr.StatusCode != http.StatusNotFound || string(herr.Body) != "no such thing\n" {
+		t.Fatalf("HTTPError: %+v", herr)
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("response: %v", resp)
+	}
+
+	if _, err := Get(srv.URL+"/missing", nil, nil); !errors.As(err, &herr) {
+		t.Fatalf("Get: %v, want *HTTPError", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv := newEchoServer(t)
+	c := NewClient(WithTimeout(time.Minute))
+
+	start := time.Now()
+	_, err := c.R().SetTimeout(50 * time.Millisecond).Get(srv.URL + "/slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.R().WithContext(ctx).Get(srv.URL + "/slow")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err: %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("took %v", elapsed)
+	}
+}
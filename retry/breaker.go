@@ -0,0 +1,392 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBreakerOpen is returned when the breaker rejects a call because it is open
+	ErrBreakerOpen = errors.New("circuit breaker is open")
+	// ErrTooManyProbes is returned when the half-open breaker already has enough probes in flight
+	ErrTooManyProbes = errors.New("circuit breaker too many half-open probes")
+
+	// errPanicked is the result recorded for a call that panicked
+	errPanicked = errors.New("circuit breaker call panicked")
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultCoolDown         = 5 * time.Second
+	defaultHalfOpenProbes   = 1
+	defaultWindowBuckets    = 10
+)
+
+// State is the state of a circuit breaker
+type State int32
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Clock tells the breaker what time it is, replace it with a FakeClock in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a manually advanced clock
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// BreakerOption is an option to new a Breaker object
+type BreakerOption func(b *Breaker)
+
+// WithFailureThreshold trips the breaker after n consecutive failures, 0 disables it, default 5
+func WithFailureThreshold(n int) BreakerOption {
+	return func(b *Breaker) {
+		b.failureThreshold = n
+	}
+}
+
+// WithErrorRate trips the breaker when the failure ratio over the sliding window reaches rate,
+// the window must contain at least minRequests calls before the ratio is considered.
+func WithErrorRate(rate float64, window time.Duration, minRequests int) BreakerOption {
+	return func(b *Breaker) {
+		b.errorRate = rate
+		b.minRequests = minRequests
+		b.window = newSlidingWindow(window, defaultWindowBuckets)
+	}
+}
+
+// WithCoolDown sets how long the breaker stays open before probing, default 5s
+func WithCoolDown(d time.Duration) BreakerOption {
+	return func(b *Breaker) {
+		b.coolDown = d
+	}
+}
+
+// WithHalfOpenProbes limits the concurrent calls let through in half-open state,
+// the same number of successes is needed to close the breaker, default 1
+func WithHalfOpenProbes(n int) BreakerOption {
+	return func(b *Breaker) {
+		if n > 0 {
+			b.halfOpenProbes = n
+		}
+	}
+}
+
+// WithStateChange registers a callback invoked on every state transition
+func WithStateChange(fn func(from, to State)) BreakerOption {
+	return func(b *Breaker) {
+		b.onStateChange = fn
+	}
+}
+
+// WithClock sets the clock the breaker measures the cool-down and the window with, default the real time
+func WithClock(c Clock) BreakerOption {
+	return func(b *Breaker) {
+		b.clock = c
+	}
+}
+
+// Breaker is a closed/open/half-open circuit breaker
+type Breaker struct {
+	mu sync.Mutex
+
+	clock            Clock
+	failureThreshold int
+	errorRate        float64
+	minRequests      int
+	coolDown         time.Duration
+	halfOpenProbes   int
+	onStateChange    func(from, to State)
+
+	state               State
+	openedAt            time.Time
+	consecutiveFailures int
+	window              *slidingWindow
+	probing             int
+	probeSuccesses      int
+	generation          uint64 // bumped on every state change
+}
+
+// NewBreaker new a circuit breaker
+func NewBreaker(opts ...BreakerOption) *Breaker {
+	b := &Breaker{
+		clock:            realClock{},
+		failureThreshold: defaultFailureThreshold,
+		coolDown:         defaultCoolDown,
+		halfOpenProbes:   defaultHalfOpenProbes,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// State returns the current state, an open breaker whose cool-down elapsed reports half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	from, to := b.advance()
+	state := b.state
+	b.mu.Unlock()
+
+	b.notify(from, to)
+	return state
+}
+
+// Allow reports whether a call may proceed, an allowed call must pass its result to done exactly once.
+// The result counts for the state the call was admitted in, it is ignored once the state changed.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	b.mu.Lock()
+	from, to := b.advance()
+	generation, err := b.allow()
+	b.mu.Unlock()
+
+	b.notify(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return func(err error) {
+		b.mu.Lock()
+		from, to := b.done(generation, err)
+		b.mu.Unlock()
+
+		b.notify(from, to)
+	}, nil
+}
+
+func (b *Breaker) allow() (uint64, error) {
+	switch b.state {
+	case StateOpen:
+		return 0, ErrBreakerOpen
+	case StateHalfOpen:
+		if b.probing >= b.halfOpenProbes {
+			return 0, ErrTooManyProbes
+		}
+		b.probing++
+	}
+	return b.generation, nil
+}
+
+func (b *Breaker) done(generation uint64, err error) (State, State) {
+	// results of calls admitted before the last state change are ignored
+	if generation != b.generation {
+		return b.state, b.state
+	}
+	now := b.clock.Now()
+
+	switch b.state {
+	case StateClosed:
+		if b.window != nil {
+			b.window.add(now, err != nil)
+		}
+		if err == nil {
+			b.consecutiveFailures = 0
+			return b.state, b.state
+		}
+
+		b.consecutiveFailures++
+		if b.shouldTrip(now) {
+			return b.setState(StateOpen, now)
+		}
+
+	case StateHalfOpen:
+		b.probing--
+		if err != nil {
+			return b.setState(StateOpen, now)
+		}
+
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.halfOpenProbes {
+			return b.setState(StateClosed, now)
+		}
+	}
+	return b.state, b.state
+}
+
+// Do runs fn when the breaker allows it and records its result, a panic of fn counts as failure
+// and is passed on
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+
+	panicked := true
+	defer func() {
+		if panicked {
+			done(errPanicked)
+		}
+	}()
+
+	err = fn()
+	panicked = false
+	done(err)
+	return err
+}
+
+// Reset forces the breaker back to closed state
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	from, to := b.setState(StateClosed, b.clock.Now())
+	b.mu.Unlock()
+
+	b.notify(from, to)
+}
+
+func (b *Breaker) shouldTrip(now time.Time) bool {
+	if b.failureThreshold > 0 && b.consecutiveFailures >= b.failureThreshold {
+		return true
+	}
+
+	if b.window == nil || b.errorRate <= 0 {
+		return false
+	}
+
+	total, failures := b.window.counts(now)
+	if total == 0 || total < b.minRequests {
+		return false
+	}
+	return float64(failures)/float64(total) >= b.errorRate
+}
+
+// advance moves an open breaker to half-open once the cool-down elapsed
+func (b *Breaker) advance() (State, State) {
+	if b.state != StateOpen {
+		return b.state, b.state
+	}
+
+	now := b.clock.Now()
+	if now.Sub(b.openedAt) < b.coolDown {
+		return b.state, b.state
+	}
+	return b.setState(StateHalfOpen, now)
+}
+
+func (b *Breaker) setState(state State, now time.Time) (State, State) {
+	from := b.state
+
+	b.state = state
+	b.generation++
+	b.consecutiveFailures = 0
+	b.probing = 0
+	b.probeSuccesses = 0
+
+	switch state {
+	case StateOpen:
+		b.openedAt = now
+	case StateClosed:
+		if b.window != nil {
+			b.window.reset()
+		}
+	}
+	return from, state
+}
+
+func (b *Breaker) notify(from, to State) {
+	if from == to || b.onStateChange == nil {
+		return
+	}
+	b.onStateChange(from, to)
+}
+
+// slidingWindow counts calls and failures in fixed size time buckets
+type slidingWindow struct {
+	size    time.Duration
+	buckets []windowBucket
+}
+
+type windowBucket struct {
+	start    int64
+	total    int
+	failures int
+}
+
+func newSlidingWindow(size time.Duration, n int) *slidingWindow {
+	if size < time.Duration(n) {
+		size = time.Duration(n)
+	}
+	return &slidingWindow{
+		size:    size,
+		buckets: make([]windowBucket, n),
+	}
+}
+
+func (w *slidingWindow) span() int64 {
+	return int64(w.size) / int64(len(w.buckets))
+}
+
+func (w *slidingWindow) add(now time.Time, failed bool) {
+	start := now.UnixNano() / w.span()
+	bucket := &w.buckets[start%int64(len(w.buckets))]
+	if bucket.start != start {
+		*bucket = windowBucket{start: start}
+	}
+
+	bucket.total++
+	if failed {
+		bucket.failures++
+	}
+}
+
+func (w *slidingWindow) counts(now time.Time) (total, failures int) {
+	oldest := now.UnixNano()/w.span() - int64(len(w.buckets)) + 1
+	for _, bucket := range w.buckets {
+		if bucket.start < oldest {
+			continue
+		}
+		total += bucket.total
+		failures += bucket.failures
+	}
+	return
+}
+
+func (w *slidingWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket{}
+	}
+}
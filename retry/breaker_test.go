@@ -0,0 +1,148 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+var errDown = errors.New("down")
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	var changes []State
+	b := NewBreaker(
+		WithClock(clock),
+		WithFailureThreshold(3),
+		WithCoolDown(time.Second),
+		WithStateChange(func(from, to State) {
+			changes = append(changes, to)
+		}),
+	)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, b.Do(func() error { return errDown }), errDown)
+	}
+	assert.Equal(t, b.State(), StateOpen)
+	_, err := b.Allow()
+	assert.Equal(t, err, ErrBreakerOpen)
+
+	clock.Advance(time.Second)
+	assert.Equal(t, b.State(), StateHalfOpen)
+	done, err := b.Allow()
+	assert.NilError(t, err)
+	_, err = b.Allow()
+	assert.Equal(t, err, ErrTooManyProbes)
+	done(nil)
+	assert.Equal(t, b.State(), StateClosed)
+
+	assert.DeepEqual(t, changes, []State{StateOpen, StateHalfOpen, StateClosed})
+}
+
+func TestBreakerHalfOpenFailure(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	b := NewBreaker(WithClock(clock), WithFailureThreshold(1), WithCoolDown(time.Second))
+
+	b.Do(func() error { return errDown })
+	clock.Advance(time.Second)
+	b.Do(func() error { return errDown })
+	assert.Equal(t, b.State(), StateOpen)
+
+	clock.Advance(500 * time.Millisecond)
+	_, err := b.Allow()
+	assert.Equal(t, err, ErrBreakerOpen)
+}
+
+func TestBreakerPanicFreesProbe(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	b := NewBreaker(WithClock(clock), WithFailureThreshold(1), WithCoolDown(time.Second))
+
+	b.Do(func() error { return errDown })
+	clock.Advance(time.Second)
+	func() {
+		defer func() { assert.Equal(t, recover(), "boom") }()
+		b.Do(func() error { panic("boom") })
+	}()
+	assert.Equal(t, b.State(), StateOpen)
+
+	clock.Advance(time.Second)
+	assert.NilError(t, b.Do(func() error { return nil }))
+	assert.Equal(t, b.State(), StateClosed)
+}
+
+func TestBreakerIgnoresResultsOfEarlierState(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	b := NewBreaker(WithClock(clock), WithFailureThreshold(1), WithCoolDown(time.Second), WithHalfOpenProbes(2))
+
+	slow, err := b.Allow()
+	assert.NilError(t, err)
+	b.Do(func() error { return errDown })
+	clock.Advance(time.Second)
+	probe, err := b.Allow()
+	assert.NilError(t, err)
+
+	// the call admitted while closed neither frees a probe nor counts as one
+	slow(nil)
+	_, err = b.Allow()
+	assert.NilError(t, err)
+	_, err = b.Allow()
+	assert.Equal(t, err, ErrTooManyProbes)
+	probe(nil)
+	assert.Equal(t, b.State(), StateHalfOpen)
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	b := NewBreaker(
+		WithClock(clock),
+		WithFailureThreshold(0),
+		WithErrorRate(0.5, 10*time.Second, 4),
+	)
+
+	b.Do(func() error { return nil })
+	b.Do(func() error { return errDown })
+	b.Do(func() error { return nil })
+	assert.Equal(t, b.State(), StateClosed)
+
+	// old results slide out of the window
+	clock.Advance(20 * time.Second)
+	b.Do(func() error { return nil })
+	b.Do(func() error { return errDown })
+	b.Do(func() error { return nil })
+	assert.Equal(t, b.State(), StateClosed)
+
+	b.Do(func() error { return errDown })
+	assert.Equal(t, b.State(), StateOpen)
+}
+
+func TestRetryWithBreaker(t *testing.T) {
+	b := NewBreaker(WithFailureThreshold(3), WithCoolDown(time.Hour))
+	r := New(WithBaseDelay(time.Millisecond), WithBreaker(b))
+
+	calls := 0
+	err := r.EnsureRetryTimes(10, func() error {
+		calls++
+		return Retriable(errDown)
+	})
+	assert.Equal(t, err, ErrBreakerOpen)
+	assert.Equal(t, calls, 3)
+}
+
+func TestRetryWithBreakerPanic(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1600000000, 0))
+	b := NewBreaker(WithClock(clock), WithFailureThreshold(1), WithCoolDown(time.Second))
+	b.Do(func() error { return errDown })
+	clock.Advance(time.Second)
+
+	r := New(WithBreaker(b))
+	func() {
+		defer func() { assert.Equal(t, recover(), "boom") }()
+		r.EnsureRetryTimes(1, func() error { panic("boom") })
+	}()
+
+	clock.Advance(time.Second)
+	assert.NilError(t, r.EnsureRetryTimes(1, func() error { return nil }))
+	assert.Equal(t, b.State(), StateClosed)
+}
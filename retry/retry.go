@@ -34,6 +34,7 @@ type Retry struct {
 	ctx      context.Context
 	base     time.Duration
 	backoff  *Backoff // if backoff not nil, use backoff, ignore base duration
+	breaker  *Breaker // if breaker not nil, stop retrying while it is open
 	recovery bool
 }
 
@@ -54,7 +55,11 @@ func (r *Retry) ensure(times int, do func() error) error {
 			return r.ctx.Err()
 		}
 
-		err = r.handle(do)
+		if r.breaker != nil {
+			err = r.breaker.Do(func() error { return r.handle(do) })
+		} else {
+			err = r.handle(do)
+		}
 		if err == nil {
 			return nil
 		}
@@ -144,6 +149,13 @@ func WithBackoff(bo *Backoff) Option {
 	}
 }
 
+// WithBreaker guards every attempt with the circuit breaker, ErrBreakerOpen is returned once it opens
+func WithBreaker(b *Breaker) Option {
+	return func(r *Retry) {
+		r.breaker = b
+	}
+}
+
 type Backoff struct {
 	MinDelay time.Duration
 	MaxDelay time.Duration
@@ -1,61 +1,259 @@
 package sema
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
 	"time"
 )
 
+var ErrInvalidUnits = errors.New("sema: units must be positive")
+
+// Semaphore is a weighted semaphore, e.g. for a memory budget in bytes.
+//
+// Waiters are served in FIFO order, a large request blocks the smaller ones
+// behind it so it is never starved. A request for more units than the size
+// blocks nobody, it waits aside until a Resize makes it fit or ctx is done.
 type Semaphore struct {
-	slots   chan struct{}
-	timeout time.Duration
+	mu        sync.Mutex
+	size      int
+	cur       int
+	timeout   time.Duration
+	waiters   list.List // of *waiter
+	oversized list.List // of *waiter for more units than the size
+
+	stats     Stats
+	lastHeld  time.Time // when cur last changed, for the held unit time
+	heldTime  time.Duration
+	releasedN uint64
+}
+
+type waiter struct {
+	n     int
+	ready chan struct{}
+	elem  *list.Element // in waiters or oversized
 }
 
+// Stats are the counters of a semaphore since its creation
+type Stats struct {
+	Size     int
+	Held     int
+	Waiters  int
+	Acquired uint64 // successful acquires
+	Canceled uint64 // acquires given up because of the context or the timeout
+
+	TotalWait time.Duration // summed wait of the acquires that had to queue
+	MaxWait   time.Duration
+	Waited    uint64 // acquires that had to queue
+
+	AvgHold time.Duration // average time a unit was held until released
+}
+
+// AvgWait returns the average wait of the acquires that had to queue
+func (s Stats) AvgWait() time.Duration {
+	if s.Waited == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Waited)
+}
+
+// NewSemaphore returns a semaphore of count units, a timeout > 0 bounds every Acquire
 func NewSemaphore(count int, timeout time.Duration) *Semaphore {
-	sem := &Semaphore{
-		slots:   make(chan struct{}, count),
-		timeout: timeout,
+	return &Semaphore{
+		size:     count,
+		timeout:  timeout,
+		lastHeld: time.Now(),
 	}
+}
 
-	for i := 0; i < count; i++ {
-		sem.slots <- struct{}{}
+// Acquire takes n units, waiting until they are free or ctx is done.
+// On failure nothing is taken and the error of the context is returned,
+// context.DeadlineExceeded also for the timeout of the semaphore.
+func (sem *Semaphore) Acquire(ctx context.Context, n int) error {
+	if n <= 0 {
+		return ErrInvalidUnits
 	}
 
-	return sem
-}
+	sem.mu.Lock()
+	if sem.size-sem.cur >= n && sem.waiters.Len() == 0 {
+		sem.take(n)
+		sem.mu.Unlock()
+		return nil
+	}
 
-func (sem *Semaphore) Acquire() bool {
-	if sem.timeout == 0 {
-		<-sem.slots
-		return true
+	w := &waiter{n: n, ready: make(chan struct{})}
+	if n > sem.size {
+		w.elem = sem.oversized.PushBack(w)
+	} else {
+		w.elem = sem.waiters.PushBack(w)
 	}
+	sem.mu.Unlock()
 
-	tm := time.NewTimer(sem.timeout)
-	defer tm.Stop()
+	if sem.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sem.timeout)
+		defer cancel()
+	}
 
+	start := time.Now()
 	select {
-	case <-sem.slots:
-		return true
-	case <-tm.C:
-		return false
+	case <-w.ready:
+		sem.mu.Lock()
+		sem.waited(time.Since(start))
+		sem.mu.Unlock()
+		return nil
+
+	case <-ctx.Done():
+		sem.mu.Lock()
+		defer sem.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// acquired meanwhile, give the units back
+			sem.put(n)
+		default:
+			isFront := sem.waiters.Front() == w.elem
+			sem.waiters.Remove(w.elem)
+			sem.oversized.Remove(w.elem)
+			if isFront {
+				// the waiters behind may fit now
+				sem.notify()
+			}
+		}
+		sem.stats.Canceled++
+		return ctx.Err()
 	}
 }
 
-func (sem *Semaphore) TryAcquire() bool {
-	select {
-	case <-sem.slots:
-		return true
-	default:
+// TryAcquire takes n units if they are free and nobody is waiting
+func (sem *Semaphore) TryAcquire(n int) bool {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	if n <= 0 || sem.size-sem.cur < n || sem.waiters.Len() > 0 {
 		return false
 	}
+	sem.take(n)
+	return true
 }
 
-func (sem *Semaphore) Release() {
-	select {
-	case sem.slots <- struct{}{}:
-	default:
+// Release gives n units back, it panics when more units are released than held
+func (sem *Semaphore) Release(n int) {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	if n > sem.cur {
 		panic("can not release")
 	}
+	sem.put(n)
 }
 
+// Resize changes the number of units. When shrinking, the units held beyond
+// the new size stay held and new acquires wait until enough are released,
+// waiters for more than the new size step aside until it grows again.
+func (sem *Semaphore) Resize(count int) {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	sem.size = count
+	for e := sem.waiters.Front(); e != nil; {
+		next := e.Next()
+		if w := e.Value.(*waiter); w.n > count {
+			sem.waiters.Remove(e)
+			w.elem = sem.oversized.PushBack(w)
+		}
+		e = next
+	}
+	for e := sem.oversized.Front(); e != nil; {
+		next := e.Next()
+		if w := e.Value.(*waiter); w.n <= count {
+			sem.oversized.Remove(e)
+			w.elem = sem.waiters.PushBack(w)
+		}
+		e = next
+	}
+	sem.notify()
+}
+
+// Size returns the number of units
+func (sem *Semaphore) Size() int {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	return sem.size
+}
+
+// SpareSem returns the units free now
 func (sem *Semaphore) SpareSem() int {
-	return len(sem.slots)
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	if spare := sem.size - sem.cur; spare > 0 {
+		return spare
+	}
+	return 0
+}
+
+func (sem *Semaphore) Stats() Stats {
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+
+	sem.hold()
+	stats := sem.stats
+	stats.Size = sem.size
+	stats.Held = sem.cur
+	stats.Waiters = sem.waiters.Len() + sem.oversized.Len()
+	if sem.releasedN > 0 {
+		stats.AvgHold = sem.heldTime / time.Duration(sem.releasedN)
+	}
+	return stats
+}
+
+// take and the helpers below need the lock held
+func (sem *Semaphore) take(n int) {
+	sem.hold()
+	sem.cur += n
+	sem.stats.Acquired++
+}
+
+func (sem *Semaphore) put(n int) {
+	sem.hold()
+	sem.cur -= n
+	sem.releasedN += uint64(n)
+	sem.notify()
+}
+
+// hold accumulates the held units over time, by Little's law its ratio to
+// the released units is the average hold time of a unit
+func (sem *Semaphore) hold() {
+	now := time.Now()
+	sem.heldTime += time.Duration(sem.cur) * now.Sub(sem.lastHeld)
+	sem.lastHeld = now
+}
+
+func (sem *Semaphore) waited(d time.Duration) {
+	sem.stats.Waited++
+	sem.stats.TotalWait += d
+	if d > sem.stats.MaxWait {
+		sem.stats.MaxWait = d
+	}
+}
+
+// notify wakes the waiters from the front as long as they fit, strictly in order
+func (sem *Semaphore) notify() {
+	for {
+		front := sem.waiters.Front()
+		if front == nil {
+			return
+		}
+
+		w := front.Value.(*waiter)
+		if sem.size-sem.cur < w.n {
+			return
+		}
+		sem.take(w.n)
+		sem.waiters.Remove(front)
+		close(w.ready)
+	}
 }
@@ -1,37 +1,174 @@
 package sema
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
 func TestSemaNoTimeout(t *testing.T) {
 	s := NewSemaphore(1, 0)
-	s.Acquire()
-	released := false
+	s.Acquire(context.Background(), 1)
+	released := make(chan bool, 1)
 
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		released = true
-		s.Release()
+		released <- true
+		s.Release(1)
 	}()
 
-	s.Acquire()
-	if !released {
+	s.Acquire(context.Background(), 1)
+	select {
+	case <-released:
+	default:
 		t.Errorf("release: false, want true")
 	}
 }
 
 func TestSemaTimeout(t *testing.T) {
 	s := NewSemaphore(1, 5*time.Millisecond)
-	s.Acquire()
+	s.Acquire(context.Background(), 1)
 
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		s.Release()
+		s.Release(1)
 	}()
 
-	if s.Acquire() {
-		t.Errorf("Acquire: true, want false")
+	if err := s.Acquire(context.Background(), 1); err != context.DeadlineExceeded {
+		t.Errorf("Acquire: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSemaWeightedFIFO(t *testing.T) {
+	s := NewSemaphore(10, 0)
+	if !s.TryAcquire(6) {
+		t.Fatal("TryAcquire(6): false, want true")
+	}
+
+	large := make(chan struct{})
+	go func() {
+		s.Acquire(context.Background(), 10)
+		close(large)
+	}()
+	for s.Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 4 units are free but the large waiter is first in line
+	if s.TryAcquire(1) {
+		t.Fatal("TryAcquire jumped the queue")
+	}
+
+	s.Release(6)
+	<-large
+	if s.SpareSem() != 0 {
+		t.Fatalf("spare: %d, want 0", s.SpareSem())
+	}
+	s.Release(10)
+}
+
+func TestSemaCancel(t *testing.T) {
+	s := NewSemaphore(2, 0)
+	s.Acquire(context.Background(), 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- s.Acquire(ctx, 2)
+	}()
+	for s.Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("Acquire: %v, want %v", err, context.Canceled)
+	}
+	// the canceled waiter no longer blocks the ones behind it
+	if !s.TryAcquire(1) {
+		t.Fatal("TryAcquire after cancel: false, want true")
+	}
+	if st := s.Stats(); st.Canceled != 1 || st.Held != 2 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+func TestSemaResize(t *testing.T) {
+	s := NewSemaphore(1, 0)
+	s.Acquire(context.Background(), 1)
+
+	done := make(chan struct{})
+	go func() {
+		s.Acquire(context.Background(), 2)
+		close(done)
+	}()
+	for s.Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Resize(3)
+	<-done
+
+	s.Resize(1)
+	s.Release(3)
+	if s.TryAcquire(2) {
+		t.Fatal("TryAcquire(2) succeeded after shrinking to 1")
+	}
+	if !s.TryAcquire(1) {
+		t.Fatal("TryAcquire(1): false, want true")
+	}
+}
+
+func TestSemaStats(t *testing.T) {
+	s := NewSemaphore(1, 0)
+	s.Acquire(context.Background(), 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Release(1)
+	}()
+	s.Acquire(context.Background(), 1)
+	s.Release(1)
+
+	st := s.Stats()
+	if st.Acquired != 2 || st.Waited != 1 || st.MaxWait < 10*time.Millisecond {
+		t.Fatalf("stats: %+v", st)
+	}
+	if st.AvgHold < 5*time.Millisecond {
+		t.Fatalf("avg hold: %v, want about 10ms", st.AvgHold)
+	}
+}
+
+func TestSemaReleasePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Release of unheld units did not panic")
+		}
+	}()
+	NewSemaphore(1, 0).Release(1)
+}
+
+func TestSemaOversized(t *testing.T) {
+	s := NewSemaphore(2, 0)
+	if s.Acquire(context.Background(), 0) != ErrInvalidUnits || s.TryAcquire(-1) {
+		t.Fatal("acquire of no units succeeded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- s.Acquire(ctx, 3) }()
+	for s.Stats().Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the oversized waiter does not block the ones behind it
+	if err := s.Acquire(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Fatalf("oversized Acquire: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if st := s.Stats(); st.Waiters != 0 || st.Held != 2 {
+		t.Fatalf("stats: %+v", st)
 	}
 }
@@ -7,6 +7,11 @@ import (
 	"time"
 )
 
+var (
+	// ErrTimeout is returned when a method does not finish within its timeout
+	ErrTimeout = errors.New("Async_Timeout")
+)
+
 type Method func(args ...interface{}) (interface{}, error)
 type LambdaMethod func() (interface{}, error)
 
@@ -46,7 +51,7 @@ func Retry(method func() (interface{}, error), maxCount int, interval time.Durat
 }
 
 func Lambda(method func() (interface{}, error), timeout time.Duration) (interface{}, error) {
-	output := make(chan interface{})
+	output := make(chan interface{}, 1)
 	go func() {
 		defer close(output)
 		defer func() {
@@ -79,7 +84,7 @@ func Lambda(method func() (interface{}, error), timeout time.Duration) (interfac
 				return res, nil
 			}
 		case <-timer.C:
-			return nil, errors.New("Async_Timeout")
+			return nil, ErrTimeout
 		}
 	} else {
 		res := <-output
@@ -185,7 +190,7 @@ func Any(methods []LambdaMethod, timeout time.Duration) ([]interface{}, error) {
 
 func AnyOne(methods []LambdaMethod, timeout time.Duration) (interface{}, []error) {
 	resChan := make(chan interface{}, len(methods))
-	errChan := make(chan []error)
+	errChan := make(chan []error, 1)
 	go func() {
 		defer func() {
 			close(resChan)
@@ -0,0 +1,225 @@
+// Package async is the context-first, typed counterpart of the taskq combinators.
+//
+// Every function takes a context that is passed down to the tasks, panics are
+// returned as *PanicError instead of going through a global handler, and the
+// goroutines started by a combinator never block once the caller has returned.
+// A task that ignores its context can still run on, but nothing waits for it.
+package async
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	// ErrNoTasks is returned by Any when no task is given
+	ErrNoTasks = errors.New("async: no tasks")
+	// ErrAllFailed is returned by Any when every task failed, it wraps the task errors
+	ErrAllFailed = errors.New("async: all tasks failed")
+)
+
+// Func is a task producing a value of type T
+type Func[T any] func(ctx context.Context) (T, error)
+
+// Result is the outcome of a single task
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+// PanicError is returned when a task panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("async: panic: %v", e.Value)
+}
+
+func safety[T any](ctx context.Context, fn Func[T]) (res T, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = &PanicError{Value: e, Stack: debug.Stack()}
+		}
+	}()
+	return fn(ctx)
+}
+
+// Call runs fn in its own goroutine and returns when it finishes or ctx is done
+func Call[T any](ctx context.Context, fn Func[T]) (T, error) {
+	output := make(chan Result[T], 1)
+	go func() {
+		res, err := safety(ctx, fn)
+		output <- Result[T]{Value: res, Err: err}
+	}()
+
+	select {
+	case res := <-output:
+		return res.Value, res.Err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// All runs fns concurrently and returns their values in order,
+// the first error cancels the remaining tasks and is returned.
+func All[T any](ctx context.Context, fns ...Func[T]) ([]T, error) {
+	return Parallel(ctx, len(fns), fns...)
+}
+
+// AllSettled runs fns concurrently and waits for every one of them,
+// a failing task does not affect the others.
+func AllSettled[T any](ctx context.Context, fns ...Func[T]) []Result[T] {
+	var wg sync.WaitGroup
+	results := make([]Result[T], len(fns))
+	for i, fn := range fns {
+		wg.Add(1)
+		go func(index int, fn Func[T]) {
+			defer wg.Done()
+			res, err := Call(ctx, fn)
+			results[index] = Result[T]{Value: res, Err: err}
+		}(i, fn)
+	}
+	wg.Wait()
+	return results
+}
+
+// Any returns the value of the first task that succeeds and cancels the others,
+// when all of them fail the error wraps ErrAllFailed and every task error.
+func Any[T any](ctx context.Context, fns ...Func[T]) (T, error) {
+	var zero T
+	if len(fns) == 0 {
+		return zero, ErrNoTasks
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type indexed struct {
+		index int
+		Result[T]
+	}
+	output := make(chan indexed, len(fns))
+	for i, fn := range fns {
+		go func(index int, fn Func[T]) {
+			res, err := safety(ctx, fn)
+			output <- indexed{index, Result[T]{Value: res, Err: err}}
+		}(i, fn)
+	}
+
+	errs := make([]error, len(fns))
+	for range fns {
+		select {
+		case res := <-output:
+			if res.Err == nil {
+				return res.Value, nil
+			}
+			errs[res.index] = res.Err
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+	return zero, errors.Join(append([]error{ErrAllFailed}, errs...)...)
+}
+
+// Series runs fns one after another and stops at the first error,
+// the values of the tasks completed so far are returned along with it.
+func Series[T any](ctx context.Context, fns ...Func[T]) ([]T, error) {
+	results := make([]T, 0, len(fns))
+	for _, fn := range fns {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		res, err := Call(ctx, fn)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Flow feeds in to the first stage and the output of every stage to the next one
+func Flow[T any](ctx context.Context, in T, stages ...func(ctx context.Context, in T) (T, error)) (T, error) {
+	res := in
+	for _, stage := range stages {
+		var (
+			stage = stage
+			arg   = res
+			err   error
+		)
+		res, err = Call(ctx, func(ctx context.Context) (T, error) {
+			return stage(ctx, arg)
+		})
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	return res, nil
+}
+
+// Parallel runs fns with at most limit tasks at once and returns their values in order,
+// the first error cancels the running tasks and stops starting new ones.
+func Parallel[T any](ctx context.Context, limit int, fns ...Func[T]) ([]T, error) {
+	if limit <= 0 {
+		limit = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		workers  = make(chan struct{}, limit)
+		results  = make([]T, len(fns))
+	)
+
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+loop:
+	for i, fn := range fns {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+
+		wg.Add(1)
+		go func(index int, fn Func[T]) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			res, err := Call(ctx, fn)
+			if err != nil {
+				fail(err)
+				return
+			}
+			results[index] = res
+		}(i, fn)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,128 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errFailed = errors.New("failed")
+
+func value(v int) Func[int] {
+	return func(ctx context.Context) (int, error) {
+		return v, nil
+	}
+}
+
+func fail(ctx context.Context) (int, error) {
+	return 0, errFailed
+}
+
+func hang(ctx context.Context) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestAll(t *testing.T) {
+	res, err := All(context.Background(), value(1), value(2), value(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []int{1, 2, 3}) {
+		t.Errorf("All: %v, want [1 2 3]", res)
+	}
+
+	start := time.Now()
+	_, err = All(context.Background(), value(1), fail, hang)
+	if err != errFailed {
+		t.Errorf("err: %v, want %v", err, errFailed)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("siblings were not cancelled")
+	}
+}
+
+func TestAllSettled(t *testing.T) {
+	res := AllSettled(context.Background(), value(1), fail)
+	if res[0].Value != 1 || res[0].Err != nil || res[1].Err != errFailed {
+		t.Errorf("AllSettled: %v", res)
+	}
+}
+
+func TestAny(t *testing.T) {
+	res, err := Any(context.Background(), fail, hang, value(2))
+	if err != nil || res != 2 {
+		t.Errorf("Any: %v %v, want 2 nil", res, err)
+	}
+
+	_, err = Any(context.Background(), fail, fail)
+	if !errors.Is(err, ErrAllFailed) || !errors.Is(err, errFailed) {
+		t.Errorf("err: %v, want %v", err, ErrAllFailed)
+	}
+
+	if _, err = Any[int](context.Background()); err != ErrNoTasks {
+		t.Errorf("err: %v, want %v", err, ErrNoTasks)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	res, err := Series(context.Background(), value(1), fail, value(3))
+	if err != errFailed {
+		t.Errorf("err: %v, want %v", err, errFailed)
+	}
+	if !reflect.DeepEqual(res, []int{1}) {
+		t.Errorf("Series: %v, want [1]", res)
+	}
+}
+
+func TestFlow(t *testing.T) {
+	double := func(ctx context.Context, in int) (int, error) {
+		return in * 2, nil
+	}
+	res, err := Flow(context.Background(), 1, double, double, double)
+	if err != nil || res != 8 {
+		t.Errorf("Flow: %v %v, want 8 nil", res, err)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	fns := make([]Func[int], 10)
+	for i := range fns {
+		fns[i] = value(i)
+	}
+	res, err := Parallel(context.Background(), 3, fns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range res {
+		if v != i {
+			t.Errorf("Parallel[%d]: %d, want %d", i, v, i)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := Call(ctx, func(ctx context.Context) (int, error) {
+		time.Sleep(time.Second)
+		return 1, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("err: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	_, err := Call(context.Background(), func(ctx context.Context) (int, error) {
+		panic("boom")
+	})
+
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" {
+		t.Errorf("err: %v, want PanicError", err)
+	}
+}
@@ -0,0 +1,699 @@
+package taskq
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDurableQueueClosed = errors.New("taskq: durable queue closed")
+	ErrJobNotFound        = errors.New("taskq: job not found")
+
+	errCorruptRecord = errors.New("taskq: corrupt log record")
+)
+
+const (
+	defaultDurableWorkers     = 1
+	defaultDurableMaxAttempts = 5
+	defaultDurableMinBackoff  = 100 * time.Millisecond
+	defaultDurableMaxBackoff  = time.Minute
+	defaultSegmentSize        = 16 << 20
+
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+
+	opPut  = "put"
+	opAck  = "ack"
+	opDead = "dead"
+)
+
+// DurableJob is a job persisted in the durable queue
+type DurableJob struct {
+	ID        uint64    `json:"id"`
+	Payload   []byte    `json:"payload"`
+	Attempts  int       `json:"attempts"`
+	NotBefore time.Time `json:"not_before"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	index int // position in the ready heap, -1 when not queued
+}
+
+// DurableHandler processes a job, a nil error acks it and any other error retries it
+type DurableHandler func(ctx context.Context, job *DurableJob) error
+
+type DurableOption func(q *DurableQueue)
+
+// WithDurableWorkers sets the number of concurrent handlers, default 1
+func WithDurableWorkers(n int) DurableOption {
+	return func(q *DurableQueue) {
+		if n > 0 {
+			q.workers = n
+		}
+	}
+}
+
+// WithMaxAttempts moves a job to the dead letters after n failed attempts, default 5
+func WithMaxAttempts(n int) DurableOption {
+	return func(q *DurableQueue) {
+		if n > 0 {
+			q.maxAttempts = n
+		}
+	}
+}
+
+// WithRetryBackoff sets the exponential delay between attempts, default 100ms up to 1m
+func WithRetryBackoff(min, max time.Duration) DurableOption {
+	return func(q *DurableQueue) {
+		q.minBackoff = min
+		q.maxBackoff = max
+	}
+}
+
+// WithSegmentSize sets the size after which the log is compacted into a new segment, default 16MB
+func WithSegmentSize(n int64) DurableOption {
+	return func(q *DurableQueue) {
+		if n > 0 {
+			q.segmentSize = n
+		}
+	}
+}
+
+// WithNoSync skips the fsync after every write, jobs may be lost on power failure but not on crash
+func WithNoSync() DurableOption {
+	return func(q *DurableQueue) {
+		q.noSync = true
+	}
+}
+
+type logRecord struct {
+	Op  string      `json:"op"`
+	ID  uint64      `json:"id,omitempty"`
+	Job *DurableJob `json:"job,omitempty"`
+}
+
+// DurableQueue is a job queue persisted in an append-only segment log.
+//
+// Jobs are delivered at least once: a job is removed from the log only after
+// its handler returned nil, so a crash in between replays it on the next open.
+type DurableQueue struct {
+	dir         string
+	handler     DurableHandler
+	workers     int
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	segmentSize int64
+	noSync      bool
+	writeRecord func(w io.Writer, rec *logRecord) (int, error) // replaced in tests
+
+	mu       sync.Mutex
+	jobs     map[uint64]*DurableJob
+	dead     map[uint64]*DurableJob
+	ready    durableHeap
+	nextID   uint64
+	segment  *os.File
+	segNum   uint64
+	segBytes int64 // end of the last complete record in segment
+	torn     bool  // segment may end with a partial record, roll to a new one before appending
+	closed   bool
+
+	work   chan *DurableJob
+	wakeup chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// OpenDurableQueue replays the log in dir and starts delivering the pending jobs to handler
+func OpenDurableQueue(dir string, handler DurableHandler, opts ...DurableOption) (*DurableQueue, error) {
+	q := &DurableQueue{
+		dir:         dir,
+		handler:     handler,
+		workers:     defaultDurableWorkers,
+		maxAttempts: defaultDurableMaxAttempts,
+		minBackoff:  defaultDurableMinBackoff,
+		maxBackoff:  defaultDurableMaxBackoff,
+		segmentSize: defaultSegmentSize,
+		jobs:        make(map[uint64]*DurableJob),
+		dead:        make(map[uint64]*DurableJob),
+		nextID:      1,
+		wakeup:      make(chan struct{}, 1),
+		writeRecord: writeRecord,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	for _, job := range q.jobs {
+		heap.Push(&q.ready, job)
+	}
+
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.work = make(chan *DurableJob)
+	q.wg.Add(q.workers + 1)
+	go q.dispatch()
+	for i := 0; i < q.workers; i++ {
+		go q.worker()
+	}
+	return q, nil
+}
+
+// Enqueue persists payload as a new job, the job is durable once Enqueue returns
+func (q *DurableQueue) Enqueue(payload []byte) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrDurableQueueClosed
+	}
+
+	now := time.Now()
+	job := &DurableJob{
+		ID:        q.nextID,
+		Payload:   payload,
+		NotBefore: now,
+		CreatedAt: now,
+		index:     -1,
+	}
+	if err := q.append(&logRecord{Op: opPut, Job: job}); err != nil {
+		return 0, err
+	}
+
+	q.nextID++
+	q.jobs[job.ID] = job
+	heap.Push(&q.ready, job)
+	q.compactIfFull()
+	q.wake()
+	return job.ID, nil
+}
+
+// Pending returns the number of jobs not acked yet, including the running ones
+func (q *DurableQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.jobs)
+}
+
+// DeadLetters returns the jobs that failed too many times, ordered by id
+func (q *DurableQueue) DeadLetters() []DurableJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]DurableJob, 0, len(q.dead))
+	for _, job := range q.dead {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// Requeue moves a dead letter back to the queue with its attempts reset
+func (q *DurableQueue) Requeue(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrDurableQueueClosed
+	}
+
+	job, ok := q.dead[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+
+	requeued := *job
+	requeued.Attempts = 0
+	requeued.NotBefore = time.Now()
+	requeued.index = -1
+	if err := q.append(&logRecord{Op: opPut, Job: &requeued}); err != nil {
+		return err
+	}
+
+	delete(q.dead, id)
+	q.jobs[id] = &requeued
+	heap.Push(&q.ready, &requeued)
+	q.compactIfFull()
+	q.wake()
+	return nil
+}
+
+// RemoveDead drops a dead letter from the log
+func (q *DurableQueue) RemoveDead(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrDurableQueueClosed
+	}
+	if _, ok := q.dead[id]; !ok {
+		return ErrJobNotFound
+	}
+	if err := q.append(&logRecord{Op: opAck, ID: id}); err != nil {
+		return err
+	}
+
+	delete(q.dead, id)
+	q.compactIfFull()
+	return nil
+}
+
+// Close stops the workers, running handlers see their context cancelled
+// and the jobs they did not ack are replayed on the next open.
+func (q *DurableQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	q.cancel()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.segment.Close()
+}
+
+func (q *DurableQueue) wake() {
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (q *DurableQueue) dispatch() {
+	defer q.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		var (
+			job  *DurableJob
+			wait = time.Hour
+		)
+		if len(q.ready) > 0 {
+			if d := time.Until(q.ready[0].NotBefore); d > 0 {
+				wait = d
+			} else {
+				job = heap.Pop(&q.ready).(*DurableJob)
+			}
+		}
+		q.mu.Unlock()
+
+		if job != nil {
+			select {
+			case q.work <- job:
+			case <-q.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-q.wakeup:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *DurableQueue) worker() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case job := <-q.work:
+			q.process(job)
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *DurableQueue) process(job *DurableJob) {
+	_, err := Safety(func() (interface{}, error) {
+		return nil, q.handler(q.ctx, job)
+	})
+	if err != nil && q.ctx.Err() != nil {
+		// interrupted by Close, the attempt is not counted and the job is replayed on the next open
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err == nil {
+		if aerr := q.append(&logRecord{Op: opAck, ID: job.ID}); aerr != nil {
+			// the ack is not durable, the job runs again instead of hanging until the next open
+			q.retryLater(job)
+			return
+		}
+		delete(q.jobs, job.ID)
+		q.compactIfFull()
+		return
+	}
+
+	failed := *job
+	failed.Attempts++
+	failed.LastError = err.Error()
+	failed.index = -1
+
+	if failed.Attempts >= q.maxAttempts {
+		if aerr := q.append(&logRecord{Op: opDead, Job: &failed}); aerr != nil {
+			q.retryLater(job)
+			return
+		}
+		delete(q.jobs, job.ID)
+		q.dead[job.ID] = &failed
+		q.compactIfFull()
+		return
+	}
+
+	failed.NotBefore = time.Now().Add(q.backoff(failed.Attempts))
+	if aerr := q.append(&logRecord{Op: opPut, Job: &failed}); aerr != nil {
+		// keep the old state in the log and in memory
+		q.retryLater(job)
+		return
+	}
+	q.jobs[job.ID] = &failed
+	heap.Push(&q.ready, &failed)
+	q.compactIfFull()
+	q.wake()
+}
+
+// retryLater puts job back into the ready queue unchanged after a failed log write
+func (q *DurableQueue) retryLater(job *DurableJob) {
+	job.NotBefore = time.Now().Add(q.minBackoff)
+	job.index = -1
+	q.jobs[job.ID] = job
+	heap.Push(&q.ready, job)
+	q.wake()
+}
+
+func (q *DurableQueue) backoff(attempts int) time.Duration {
+	d := float64(q.minBackoff) * math.Pow(2, float64(attempts-1))
+	if d > float64(q.maxBackoff) {
+		return q.maxBackoff
+	}
+	return time.Duration(d)
+}
+
+func segmentName(n uint64) string {
+	return fmt.Sprintf("%s%020d%s", segmentPrefix, n, segmentSuffix)
+}
+
+func (q *DurableQueue) segments() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(q.dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var nums []uint64
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), segmentPrefix), segmentSuffix)
+		var n uint64
+		if _, err := fmt.Sscanf(name, "%d", &n); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+func (q *DurableQueue) replay() error {
+	nums, err := q.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nums {
+		if err := q.replaySegment(filepath.Join(q.dir, segmentName(n))); err != nil {
+			return err
+		}
+		q.segNum = n
+	}
+	return nil
+}
+
+func (q *DurableQueue) replaySegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == errCorruptRecord || err == io.ErrUnexpectedEOF {
+			// torn write at the tail of a crashed segment, the rest is dropped by compaction
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		q.apply(rec)
+	}
+}
+
+func (q *DurableQueue) apply(rec *logRecord) {
+	switch rec.Op {
+	case opPut:
+		rec.Job.index = -1
+		q.jobs[rec.Job.ID] = rec.Job
+		delete(q.dead, rec.Job.ID)
+		if rec.Job.ID >= q.nextID {
+			q.nextID = rec.Job.ID + 1
+		}
+	case opAck:
+		delete(q.jobs, rec.ID)
+		delete(q.dead, rec.ID)
+	case opDead:
+		rec.Job.index = -1
+		delete(q.jobs, rec.Job.ID)
+		q.dead[rec.Job.ID] = rec.Job
+		if rec.Job.ID >= q.nextID {
+			q.nextID = rec.Job.ID + 1
+		}
+	}
+}
+
+// compact writes the live jobs into a new segment and removes the older ones
+func (q *DurableQueue) compact() error {
+	old, err := q.segments()
+	if err != nil {
+		return err
+	}
+
+	q.segNum++
+	f, err := os.OpenFile(filepath.Join(q.dir, segmentName(q.segNum)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	w := bufio.NewWriter(f)
+	write := func(rec *logRecord) error {
+		n, err := writeRecord(w, rec)
+		size += int64(n)
+		return err
+	}
+	for _, job := range q.jobs {
+		if err = write(&logRecord{Op: opPut, Job: job}); err != nil {
+			break
+		}
+	}
+	for _, job := range q.dead {
+		if err != nil {
+			break
+		}
+		err = write(&logRecord{Op: opDead, Job: job})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// a partial segment would shadow the records appended to the current one on replay
+		f.Close()
+		os.Remove(f.Name())
+		q.segNum--
+		return err
+	}
+
+	if q.segment != nil {
+		q.segment.Close()
+	}
+	q.segment = f
+	q.segBytes = size
+
+	for _, n := range old {
+		os.Remove(filepath.Join(q.dir, segmentName(n)))
+	}
+	return nil
+}
+
+func (q *DurableQueue) append(rec *logRecord) error {
+	if q.torn {
+		if err := q.compact(); err != nil {
+			return err
+		}
+		q.torn = false
+	}
+
+	n, err := q.writeRecord(q.segment, rec)
+	if err == nil && !q.noSync {
+		err = q.segment.Sync()
+	}
+	if err != nil {
+		q.discardTail()
+		return err
+	}
+
+	q.segBytes += int64(n)
+	return nil
+}
+
+// discardTail cuts what a failed append left behind, replay stops at a torn record
+// and would lose the records appended after it. When the segment can not be cut,
+// the next append rolls to a new segment written from the in-memory state.
+func (q *DurableQueue) discardTail() {
+	if err := q.segment.Truncate(q.segBytes); err != nil {
+		q.torn = true
+		return
+	}
+	if _, err := q.segment.Seek(q.segBytes, io.SeekStart); err != nil {
+		q.torn = true
+	}
+}
+
+// compactIfFull compacts the log once the segment outgrew the segment size. It runs after
+// the in-memory state took the appended record, compaction rewrites the log from that state.
+// The record is durable in the current segment already, a failed compaction is retried on
+// the next append.
+func (q *DurableQueue) compactIfFull() {
+	if q.segBytes >= q.segmentSize {
+		q.compact()
+	}
+}
+
+// a record is framed as a big endian uint32 length, the crc32 of the payload and the json payload
+func writeRecord(w io.Writer, rec *logRecord) (int, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[8:], payload)
+	return w.Write(buf)
+}
+
+func readRecord(r io.Reader) (*logRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorruptRecord
+	}
+
+	rec := &logRecord{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, errCorruptRecord
+	}
+	if (rec.Op == opPut || rec.Op == opDead) && rec.Job == nil {
+		return nil, errCorruptRecord
+	}
+	return rec, nil
+}
+
+// durableHeap orders ready jobs by NotBefore
+type durableHeap []*DurableJob
+
+func (h durableHeap) Len() int { return len(h) }
+func (h durableHeap) Less(i, j int) bool {
+	if h[i].NotBefore.Equal(h[j].NotBefore) {
+		return h[i].ID < h[j].ID
+	}
+	return h[i].NotBefore.Before(h[j].NotBefore)
+}
+
+func (h durableHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *durableHeap) Push(x interface{}) {
+	job := x.(*DurableJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *durableHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*h = old[:n-1]
+	return job
+}
@@ -0,0 +1,252 @@
+package taskq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDurableQueueAck(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	q, err := OpenDurableQueue(t.TempDir(), func(ctx context.Context, job *DurableJob) error {
+		mu.Lock()
+		got = append(got, string(job.Payload))
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("b"))
+	waitFor(t, func() bool { return q.Pending() == 0 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("handled: %v, want [a b]", got)
+	}
+}
+
+func TestDurableQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	block := func(ctx context.Context, job *DurableJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	q, err := OpenDurableQueue(dir, block, WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("b"))
+	q.Close()
+
+	// simulate a torn write at the tail of the log
+	segs, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	f, _ := os.OpenFile(segs[len(segs)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	handled := make(chan string, 2)
+	q, err = OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		handled <- string(job.Payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	waitFor(t, func() bool { return q.Pending() == 0 })
+	if len(handled) != 2 {
+		t.Errorf("replayed: %d, want 2", len(handled))
+	}
+
+	id, _ := q.Enqueue([]byte("c"))
+	if id != 3 {
+		t.Errorf("id: %d, want 3", id)
+	}
+}
+
+func TestDurableQueueDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+
+	failed := errors.New("failed")
+	q, err := OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		return failed
+	}, WithMaxAttempts(3), WithRetryBackoff(time.Millisecond, 5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := q.Enqueue([]byte("a"))
+	waitFor(t, func() bool { return len(q.DeadLetters()) == 1 })
+	q.Close()
+
+	q, err = OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	dead := q.DeadLetters()
+	if len(dead) != 1 || dead[0].ID != id || dead[0].Attempts != 3 || dead[0].LastError != "failed" {
+		t.Fatalf("dead letters: %+v", dead)
+	}
+
+	if err := q.Requeue(id); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return q.Pending() == 0 })
+	if len(q.DeadLetters()) != 0 {
+		t.Error("requeued job is still a dead letter")
+	}
+	if err := q.RemoveDead(id); err != ErrJobNotFound {
+		t.Errorf("RemoveDead: %v, want %v", err, ErrJobNotFound)
+	}
+}
+
+func TestDurableQueueCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		return nil
+	}, WithSegmentSize(512), WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 100; i++ {
+		q.Enqueue([]byte("payload"))
+	}
+	waitFor(t, func() bool { return q.Pending() == 0 })
+
+	segs, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	if len(segs) != 1 {
+		t.Errorf("segments: %d, want 1", len(segs))
+	}
+}
+
+func TestDurableQueueCompactionKeepsNewState(t *testing.T) {
+	dir := t.TempDir()
+
+	block := func(ctx context.Context, job *DurableJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	// every append compacts the log
+	q, err := OpenDurableQueue(dir, block, WithSegmentSize(1), WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := q.Enqueue([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = OpenDurableQueue(dir, block, WithSegmentSize(1), WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 1 {
+		t.Fatalf("pending after reopen: %d, want job %d", n, id)
+	}
+}
+
+func TestDurableQueueAckWriteFails(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	q, err := OpenDurableQueue(t.TempDir(), func(ctx context.Context, job *DurableJob) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		return nil
+	}, WithRetryBackoff(time.Millisecond, time.Millisecond), WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Enqueue([]byte("a"))
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+
+	// the ack can not be written, the job must be delivered again instead of getting stuck
+	q.mu.Lock()
+	q.segment.Close()
+	q.mu.Unlock()
+	close(release)
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) >= 2 })
+	// the log rolled to a new segment, so the ack of the redelivery is written
+	waitFor(t, func() bool { return q.Pending() == 0 })
+}
+
+func TestDurableQueueTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Enqueue([]byte("a"))
+	q.mu.Lock()
+	q.writeRecord = func(w io.Writer, rec *logRecord) (int, error) {
+		q.writeRecord = writeRecord
+		var buf bytes.Buffer
+		n, _ := writeRecord(&buf, rec)
+		w.Write(buf.Bytes()[:n/2])
+		return n / 2, io.ErrShortWrite
+	}
+	q.mu.Unlock()
+
+	if _, err := q.Enqueue([]byte("torn")); err != io.ErrShortWrite {
+		t.Fatalf("Enqueue: %v, want %v", err, io.ErrShortWrite)
+	}
+	q.Enqueue([]byte("b"))
+	q.Enqueue([]byte("c"))
+	q.Close()
+
+	q, err = OpenDurableQueue(dir, func(ctx context.Context, job *DurableJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 3 {
+		t.Fatalf("pending after reopen: %d, want the 3 acknowledged jobs", n)
+	}
+}
@@ -0,0 +1,321 @@
+package taskq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolClosed = errors.New("taskq: pool closed")
+	ErrQueueFull  = errors.New("taskq: queue full")
+)
+
+const (
+	defaultPoolQueueSize   = 1024
+	defaultPoolIdleTimeout = 10 * time.Second
+)
+
+// Priority of a job in the pool, higher priorities are started first
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh) + 1
+)
+
+// PoolStats is a snapshot of the pool metrics
+type PoolStats struct {
+	QueueDepth    int // jobs waiting for a worker
+	ActiveWorkers int // workers running a job
+	Workers       int // running plus idle workers
+	Submitted     uint64
+	Completed     uint64
+	Panics        uint64
+	TotalWait     time.Duration // sum of the time jobs spent queued
+	MaxWait       time.Duration
+}
+
+// AvgWait is the mean time a started job spent in the queue
+func (s PoolStats) AvgWait() time.Duration {
+	started := s.Completed + uint64(s.ActiveWorkers)
+	if started == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(started)
+}
+
+type PoolOption func(p *Pool)
+
+// WithMaxWorkers limits the number of concurrent workers, default runtime.NumCPU()
+func WithMaxWorkers(n int) PoolOption {
+	return func(p *Pool) {
+		if n > 0 {
+			p.maxWorkers = n
+		}
+	}
+}
+
+// WithQueueSize bounds the number of queued jobs over all priorities, default 1024
+func WithQueueSize(n int) PoolOption {
+	return func(p *Pool) {
+		if n > 0 {
+			p.queueSize = n
+		}
+	}
+}
+
+// WithIdleTimeout sets how long a worker waits for a job before exiting, default 10s
+func WithIdleTimeout(d time.Duration) PoolOption {
+	return func(p *Pool) {
+		if d > 0 {
+			p.idleTimeout = d
+		}
+	}
+}
+
+// WithPoolPanicHandler is called with the recovered error of a panicking job,
+// the handler set by SetPanicHandler is used when not given.
+func WithPoolPanicHandler(handler func(interface{})) PoolOption {
+	return func(p *Pool) {
+		p.panicHandler = handler
+	}
+}
+
+type job struct {
+	fn       func()
+	enqueued time.Time
+}
+
+// Pool is a long-lived worker pool with a bounded priority queue
+type Pool struct {
+	maxWorkers   int
+	queueSize    int
+	idleTimeout  time.Duration
+	panicHandler func(interface{})
+
+	mu      sync.Mutex
+	queues  [numPriorities][]*job
+	queued  int
+	workers int
+	idle    int
+	closed  bool
+	stats   PoolStats
+
+	space   chan struct{} // a slot is held by every queued job
+	notify  chan struct{} // a token is sent for every queued job
+	closing chan struct{}
+
+	jobsWg    sync.WaitGroup
+	workersWg sync.WaitGroup
+}
+
+func NewPool(opts ...PoolOption) *Pool {
+	p := &Pool{
+		maxWorkers:  runtime.NumCPU(),
+		queueSize:   defaultPoolQueueSize,
+		idleTimeout: defaultPoolIdleTimeout,
+		closing:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.space = make(chan struct{}, p.queueSize)
+	p.notify = make(chan struct{}, p.queueSize)
+	return p
+}
+
+// Submit queues fn, it blocks while the queue is full
+func (p *Pool) Submit(pri Priority, fn func()) error {
+	return p.SubmitContext(context.Background(), pri, fn)
+}
+
+// TrySubmit queues fn, ErrQueueFull is returned at once when the queue is full
+func (p *Pool) TrySubmit(pri Priority, fn func()) error {
+	select {
+	case p.space <- struct{}{}:
+	case <-p.closing:
+		return ErrPoolClosed
+	default:
+		return ErrQueueFull
+	}
+	return p.enqueue(pri, fn)
+}
+
+// SubmitContext queues fn, it blocks while the queue is full until ctx is done
+func (p *Pool) SubmitContext(ctx context.Context, pri Priority, fn func()) error {
+	select {
+	case p.space <- struct{}{}:
+	case <-p.closing:
+		return ErrPoolClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.enqueue(pri, fn)
+}
+
+func (p *Pool) enqueue(pri Priority, fn func()) error {
+	if pri < PriorityLow {
+		pri = PriorityLow
+	}
+	if pri > PriorityHigh {
+		pri = PriorityHigh
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		<-p.space
+		return ErrPoolClosed
+	}
+
+	p.jobsWg.Add(1)
+	p.queues[pri] = append(p.queues[pri], &job{fn: fn, enqueued: time.Now()})
+	p.queued++
+	p.stats.Submitted++
+	p.notify <- struct{}{}
+
+	if p.queued > p.idle && p.workers < p.maxWorkers {
+		p.workers++
+		p.idle++
+		p.workersWg.Add(1)
+		go p.worker()
+	}
+	return nil
+}
+
+func (p *Pool) dequeue() *job {
+	for pri := numPriorities - 1; pri >= 0; pri-- {
+		if q := p.queues[pri]; len(q) > 0 {
+			j := q[0]
+			q[0] = nil
+			p.queues[pri] = q[1:]
+			p.queued--
+			return j
+		}
+	}
+	return nil
+}
+
+func (p *Pool) worker() {
+	defer p.workersWg.Done()
+
+	idle := time.NewTimer(p.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-p.notify:
+			p.run()
+
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(p.idleTimeout)
+
+		case <-idle.C:
+			if p.exit() {
+				return
+			}
+			idle.Reset(p.idleTimeout)
+
+		case <-p.closing:
+			if p.exit() {
+				return
+			}
+		}
+	}
+}
+
+// exit retires an idle worker unless a job was queued meanwhile
+func (p *Pool) exit() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.notify) > 0 {
+		return false
+	}
+	p.workers--
+	p.idle--
+	return true
+}
+
+func (p *Pool) run() {
+	p.mu.Lock()
+	j := p.dequeue()
+	p.idle--
+	wait := time.Since(j.enqueued)
+	p.stats.TotalWait += wait
+	if wait > p.stats.MaxWait {
+		p.stats.MaxWait = wait
+	}
+	p.mu.Unlock()
+
+	<-p.space
+	panicked := p.safety(j.fn)
+
+	p.mu.Lock()
+	p.idle++
+	p.stats.Completed++
+	if panicked {
+		p.stats.Panics++
+	}
+	p.mu.Unlock()
+
+	p.jobsWg.Done()
+}
+
+func (p *Pool) safety(fn func()) (panicked bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			panicked = true
+
+			handler := p.panicHandler
+			if handler == nil {
+				handler = panicHandler
+			}
+			if handler != nil {
+				handler(fmt.Errorf("%v", e))
+			}
+		}
+	}()
+
+	fn()
+	return
+}
+
+// Stats returns a snapshot of the pool metrics
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.QueueDepth = p.queued
+	stats.Workers = p.workers
+	stats.ActiveWorkers = p.workers - p.idle
+	return stats
+}
+
+// Close stops accepting jobs, waits for the queued and running ones and stops the workers
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.closing)
+	}
+	p.mu.Unlock()
+
+	p.jobsWg.Wait()
+	p.workersWg.Wait()
+}
@@ -0,0 +1,115 @@
+package taskq
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolMaxWorkers(t *testing.T) {
+	p := NewPool(WithMaxWorkers(3))
+
+	var running, peak int32
+	for i := 0; i < 20; i++ {
+		p.Submit(PriorityNormal, func() {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	p.Close()
+
+	if peak > 3 {
+		t.Errorf("peak workers: %d, want <= 3", peak)
+	}
+	if stats := p.Stats(); stats.Completed != 20 || stats.Workers != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestPoolPriority(t *testing.T) {
+	p := NewPool(WithMaxWorkers(1))
+	defer p.Close()
+
+	block := make(chan struct{})
+	p.Submit(PriorityNormal, func() { <-block })
+
+	var (
+		mu    sync.Mutex
+		order []Priority
+		wg    sync.WaitGroup
+	)
+	for _, pri := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		pri := pri
+		wg.Add(1)
+		p.Submit(pri, func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, pri)
+			mu.Unlock()
+		})
+	}
+	close(block)
+	wg.Wait()
+
+	if order[0] != PriorityHigh || order[2] != PriorityLow {
+		t.Errorf("order: %v, want high first and low last", order)
+	}
+}
+
+func TestPoolBackpressure(t *testing.T) {
+	p := NewPool(WithMaxWorkers(1), WithQueueSize(1))
+
+	block := make(chan struct{})
+	p.Submit(PriorityNormal, func() { <-block })
+	for p.Stats().ActiveWorkers != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Submit(PriorityNormal, func() {})
+
+	if err := p.TrySubmit(PriorityNormal, func() {}); err != ErrQueueFull {
+		t.Errorf("TrySubmit: %v, want %v", err, ErrQueueFull)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.SubmitContext(ctx, PriorityNormal, func() {}); err != context.DeadlineExceeded {
+		t.Errorf("SubmitContext: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(block)
+	p.Close()
+	if err := p.Submit(PriorityNormal, func() {}); err != ErrPoolClosed {
+		t.Errorf("Submit: %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+func TestPoolPanicAndIdle(t *testing.T) {
+	var recovered int32
+	p := NewPool(
+		WithIdleTimeout(10*time.Millisecond),
+		WithPoolPanicHandler(func(interface{}) {
+			atomic.AddInt32(&recovered, 1)
+		}),
+	)
+	defer p.Close()
+
+	p.Submit(PriorityNormal, func() { panic("boom") })
+	time.Sleep(50 * time.Millisecond)
+
+	stats := p.Stats()
+	if recovered != 1 || stats.Panics != 1 {
+		t.Errorf("panics: %d %d, want 1", recovered, stats.Panics)
+	}
+	if stats.Workers != 0 {
+		t.Errorf("idle workers were not shrunk: %d", stats.Workers)
+	}
+}
@@ -0,0 +1,392 @@
+package taskq
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	timerPool "github.com/rfyiamcool/golib/timer_pool"
+)
+
+var (
+	ErrSchedulerStopped = errors.New("taskq: scheduler stopped")
+)
+
+// Clock is the time source of the Scheduler, replace it with a FakeClock in tests
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer firing once the clock reaches deadline
+	NewTimer(deadline time.Time) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(deadline time.Time) Timer {
+	return &realTimer{timerPool.GlobalTimerPool.Get(time.Until(deadline))}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *realTimer) Stop() {
+	timerPool.GlobalTimerPool.Put(t.t)
+}
+
+// FakeClock is a manually advanced clock, its timers fire in Advance
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(deadline time.Time) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: deadline, c: make(chan time.Time, 1)}
+	if !deadline.After(c.now) {
+		t.c <- c.now
+		return t
+	}
+	c.timers[t] = struct{}{}
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers that are due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	delete(t.clock.timers, t)
+}
+
+type SchedulerOption func(s *Scheduler)
+
+func WithClock(c Clock) SchedulerOption {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+type JobOption func(j *Job)
+
+// WithJitter delays every run of the job by a random duration in [0, d)
+func WithJitter(d time.Duration) JobOption {
+	return func(j *Job) {
+		j.jitter = d
+	}
+}
+
+// WithSkipIfRunning skips a run while the previous one has not returned yet
+func WithSkipIfRunning() JobOption {
+	return func(j *Job) {
+		j.skipIfRunning = true
+	}
+}
+
+// Job is a scheduled function
+type Job struct {
+	fn            func()
+	cron          *CronSchedule
+	jitter        time.Duration
+	skipIfRunning bool
+
+	planned time.Time // activation time without jitter
+	next    time.Time
+	index   int // position in the scheduler heap, -1 when not scheduled
+	running int32
+	skipped uint64
+
+	s *Scheduler
+}
+
+// Cancel removes the job from its scheduler, it reports whether the job was still scheduled.
+// A run already started is not interrupted.
+func (j *Job) Cancel() bool {
+	j.s.mu.Lock()
+	defer j.s.mu.Unlock()
+
+	if j.index < 0 {
+		return false
+	}
+	heap.Remove(&j.s.jobs, j.index)
+	j.s.wake()
+	return true
+}
+
+// Next returns the next planned activation, zero when the job is done or cancelled
+func (j *Job) Next() time.Time {
+	j.s.mu.Lock()
+	defer j.s.mu.Unlock()
+
+	if j.index < 0 {
+		return time.Time{}
+	}
+	return j.planned
+}
+
+// Skipped returns how many runs were skipped because the previous one was still running
+func (j *Job) Skipped() uint64 {
+	return atomic.LoadUint64(&j.skipped)
+}
+
+// Scheduler runs jobs after a delay, at a given time or on a cron schedule
+type Scheduler struct {
+	clock Clock
+
+	mu      sync.Mutex
+	jobs    jobHeap
+	stopped bool
+
+	wakeup chan struct{}
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewScheduler(opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		clock:  realClock{},
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.wg.Add(1)
+	go s.runloop()
+	return s
+}
+
+// After runs fn once after d
+func (s *Scheduler) After(d time.Duration, fn func(), opts ...JobOption) (*Job, error) {
+	return s.At(s.clock.Now().Add(d), fn, opts...)
+}
+
+// At runs fn once at t
+func (s *Scheduler) At(t time.Time, fn func(), opts ...JobOption) (*Job, error) {
+	j := s.newJob(fn, opts...)
+	return j, s.schedule(j, t)
+}
+
+// Cron runs fn on every activation of the cron expression
+func (s *Scheduler) Cron(expr string, fn func(), opts ...JobOption) (*Job, error) {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	j := s.newJob(fn, opts...)
+	j.cron = cron
+	return j, s.schedule(j, cron.Next(s.clock.Now()))
+}
+
+func (s *Scheduler) newJob(fn func(), opts ...JobOption) *Job {
+	j := &Job{fn: fn, index: -1, s: s}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
+
+func (s *Scheduler) schedule(j *Job, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrSchedulerStopped
+	}
+	s.push(j, t)
+	return nil
+}
+
+func (s *Scheduler) push(j *Job, t time.Time) {
+	j.planned = t
+	j.next = t
+	if j.jitter > 0 {
+		j.next = t.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+	}
+	heap.Push(&s.jobs, j)
+	s.wake()
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) runloop() {
+	defer s.wg.Done()
+
+	for {
+		var (
+			timer Timer
+			due   <-chan time.Time
+		)
+
+		s.mu.Lock()
+		if len(s.jobs) > 0 {
+			timer = s.clock.NewTimer(s.jobs[0].next)
+			due = timer.C()
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-due:
+			s.fire()
+		case <-s.wakeup:
+		case <-s.quit:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *Scheduler) fire() {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.jobs) > 0 && !s.jobs[0].next.After(now) {
+		j := heap.Pop(&s.jobs).(*Job)
+		s.run(j)
+
+		if j.cron == nil {
+			continue
+		}
+		if next := j.cron.Next(now); !next.IsZero() {
+			s.push(j, next)
+		}
+	}
+}
+
+func (s *Scheduler) run(j *Job) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		if j.skipIfRunning {
+			atomic.AddUint64(&j.skipped, 1)
+			return
+		}
+		atomic.AddInt32(&j.running, 1)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			atomic.AddInt32(&j.running, -1)
+			s.wg.Done()
+		}()
+
+		Safety(func() (interface{}, error) {
+			j.fn()
+			return nil, nil
+		})
+	}()
+}
+
+// Stop cancels all jobs and waits for the running ones to return
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	for _, j := range s.jobs {
+		j.index = -1
+	}
+	s.jobs = nil
+	s.mu.Unlock()
+
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// jobHeap orders jobs by their next activation
+type jobHeap []*Job
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	j := x.(*Job)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	j.index = -1
+	*h = old[:n-1]
+	return j
+}
@@ -0,0 +1,127 @@
+package taskq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2020, 1, 1, 10, 2, 30, 0, time.UTC) // wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/5 * * * *", time.Date(2020, 1, 1, 10, 5, 0, 0, time.UTC)},
+		{"0 9-18 * * *", time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"30 8 * * 1-5", time.Date(2020, 1, 2, 8, 30, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		cron, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.expr, err)
+			continue
+		}
+		if got := cron.Next(base); !got.Equal(test.want) {
+			t.Errorf("ParseCron(%q).Next=%v, want %v", test.expr, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): nil error", expr)
+		}
+	}
+}
+
+func waitRuns(t *testing.T, runs *int32, want int32) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(runs) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("runs: %d, want %d", atomic.LoadInt32(runs), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerAfter(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewScheduler(WithClock(clock))
+	defer s.Stop()
+
+	var runs int32
+	j, _ := s.After(time.Minute, func() { atomic.AddInt32(&runs, 1) })
+	cancelled, _ := s.After(time.Minute, func() { atomic.AddInt32(&runs, 100) })
+	if !cancelled.Cancel() {
+		t.Fatal("Cancel: false, want true")
+	}
+
+	clock.Advance(30 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != 0 {
+		t.Fatal("job ran too early")
+	}
+
+	clock.Advance(30 * time.Second)
+	waitRuns(t, &runs, 1)
+
+	time.Sleep(10 * time.Millisecond)
+	if runs != 1 || !j.Next().IsZero() || j.Cancel() {
+		t.Errorf("runs: %d, want a single run", runs)
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewScheduler(WithClock(clock))
+	defer s.Stop()
+
+	var runs int32
+	release := make(chan struct{})
+	j, err := s.Cron("*/5 * * * *", func() {
+		atomic.AddInt32(&runs, 1)
+		<-release
+	}, WithSkipIfRunning())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(5 * time.Minute)
+	waitRuns(t, &runs, 1)
+
+	for j.Next() != time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC) {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5 * time.Minute)
+	for j.Skipped() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	for atomic.LoadInt32(&j.running) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(5 * time.Minute)
+	waitRuns(t, &runs, 2)
+}
+
+func TestSchedulerStop(t *testing.T) {
+	s := NewScheduler()
+
+	var runs int32
+	s.After(time.Hour, func() { atomic.AddInt32(&runs, 1) })
+	s.Stop()
+
+	if _, err := s.After(time.Millisecond, func() {}); err != ErrSchedulerStopped {
+		t.Errorf("After: %v, want %v", err, ErrSchedulerStopped)
+	}
+	if runs != 0 {
+		t.Errorf("runs: %d, want 0", runs)
+	}
+}
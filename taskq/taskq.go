@@ -1,23 +1,36 @@
 package taskq
 
 import (
+	"context"
 	"errors"
 	"sync"
 )
 
+var (
+	ErrDestoried = errors.New("TaskQueue Destoried")
+)
+
+// Result is the outcome of a task, callers sharing the same key get the same result
+type Result struct {
+	Value  interface{}
+	Err    error
+	Shared bool // true when the result came from a task started by another caller
+}
+
 type request struct {
 	key      string
 	method   func() (interface{}, error)
-	callback chan interface{}
+	callback chan *Result
 }
 
 type reply struct {
 	key    string
-	result interface{}
+	result *Result
 }
 
 type TaskQueue struct {
-	callbackDic map[string][]chan interface{}
+	mu          sync.Mutex
+	callbackDic map[string][]chan *Result
 	inputQueue  chan *request
 	outputQueue chan *reply
 	shutdown    chan bool
@@ -28,7 +41,7 @@ type TaskQueue struct {
 
 func NewTaskQueeu() *TaskQueue {
 	m := &TaskQueue{
-		callbackDic: make(map[string][]chan interface{}),
+		callbackDic: make(map[string][]chan *Result),
 		inputQueue:  make(chan *request, 16),
 		outputQueue: make(chan *reply, 4),
 		shutdown:    make(chan bool),
@@ -49,8 +62,9 @@ func (m *TaskQueue) runloop() {
 			{
 				target, ok := m.callbackDic[rep.key]
 				if ok {
-					for _, callback := range target {
-						callback <- rep.result
+					for i, callback := range target {
+						// callbacks are buffered, callers that gave up never block the loop
+						callback <- &Result{Value: rep.result.Value, Err: rep.result.Err, Shared: i > 0}
 					}
 					delete(m.callbackDic, rep.key)
 				}
@@ -61,51 +75,97 @@ func (m *TaskQueue) runloop() {
 				if ok {
 					m.callbackDic[req.key] = append(target, req.callback)
 				} else {
-					target = make([]chan interface{}, 1)
+					target = make([]chan *Result, 1)
 					target[0] = req.callback
 					m.callbackDic[req.key] = target
 
-					go func(key string, method func() (interface{}, error)) {
-						res, err := Lambda(method, 0)
-						if err != nil {
-							m.outputQueue <- &reply{key: key, result: err}
-						} else {
-							m.outputQueue <- &reply{key: key, result: res}
-						}
-					}(req.key, req.method)
+					go m.run(req.key, req.method)
 				}
 			}
 		}
 	}
 }
 
+func (m *TaskQueue) run(key string, method func() (interface{}, error)) {
+	res, err := Safety(method)
+	rep := &reply{key: key, result: &Result{Value: res, Err: err}}
+
+	select {
+	case m.outputQueue <- rep:
+	case <-m.shutdown:
+	}
+}
+
+// Destory rejects all pending requests at once, waiting callers get ErrDestoried
 func (m *TaskQueue) Destory() {
+	m.mu.Lock()
+	m.isDestory = true
+	m.mu.Unlock()
+
+	m.destoryOnce.Do(func() {
+		close(m.shutdown)
+	})
+}
+
+// Shutdown stops accepting requests and waits for the pending ones to finish,
+// the remaining requests are rejected when ctx is done before that.
+func (m *TaskQueue) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.isDestory = true
+	m.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
 	m.destoryOnce.Do(func() {
-		m.isDestory = true
+		close(m.shutdown)
 	})
-	m.wg.Wait()
-	close(m.shutdown)
-	close(m.inputQueue)
-	close(m.outputQueue)
+	return err
 }
 
 func (m *TaskQueue) Exec(key string, method func() (interface{}, error)) (interface{}, error) {
+	res := m.ExecContext(context.Background(), key, method)
+	return res.Value, res.Err
+}
+
+// ExecContext runs method once for all concurrent callers of the same key,
+// the caller stops waiting when ctx is done while the method keeps running for the others.
+func (m *TaskQueue) ExecContext(ctx context.Context, key string, method func() (interface{}, error)) *Result {
+	m.mu.Lock()
 	if m.isDestory {
-		return nil, errors.New("TaskQueue Destoried")
+		m.mu.Unlock()
+		return &Result{Err: ErrDestoried}
 	}
-
 	m.wg.Add(1)
+	m.mu.Unlock()
+
 	defer m.wg.Done()
 
-	callback := make(chan interface{}, 1)
-	m.inputQueue <- &request{key: key, method: method, callback: callback}
+	callback := make(chan *Result, 1)
+	select {
+	case m.inputQueue <- &request{key: key, method: method, callback: callback}:
+	case <-ctx.Done():
+		return &Result{Err: ctx.Err()}
+	case <-m.shutdown:
+		return &Result{Err: ErrDestoried}
+	}
 
-	res := <-callback
-	close(callback)
-	switch res.(type) {
-	case error:
-		return nil, res.(error)
-	default:
-		return res, nil
+	select {
+	case res := <-callback:
+		return res
+	case <-ctx.Done():
+		return &Result{Err: ctx.Err()}
+	case <-m.shutdown:
+		return &Result{Err: ErrDestoried}
 	}
 }
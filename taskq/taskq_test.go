@@ -0,0 +1,128 @@
+package taskq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExecShared(t *testing.T) {
+	q := NewTaskQueeu()
+	defer q.Destory()
+
+	var (
+		calls int32
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := q.Exec("k", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-start
+				return 1, nil
+			})
+			if err != nil || res.(int) != 1 {
+				t.Errorf("Exec: %v %v, want 1 nil", res, err)
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("calls: %d, want 1", calls)
+	}
+}
+
+func TestExecError(t *testing.T) {
+	q := NewTaskQueeu()
+	defer q.Destory()
+
+	want := errors.New("failed")
+	_, err := q.Exec("k", func() (interface{}, error) {
+		return nil, want
+	})
+	if err != want {
+		t.Errorf("err: %v, want %v", err, want)
+	}
+
+	_, err = q.Exec("k", func() (interface{}, error) {
+		panic("boom")
+	})
+	if err == nil || err.Error() != "boom" {
+		t.Errorf("err: %v, want boom", err)
+	}
+}
+
+func TestExecContextCancel(t *testing.T) {
+	q := NewTaskQueeu()
+	defer q.Destory()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	res := q.ExecContext(ctx, "k", func() (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	if res.Err != context.DeadlineExceeded {
+		t.Errorf("err: %v, want %v", res.Err, context.DeadlineExceeded)
+	}
+}
+
+func TestDestory(t *testing.T) {
+	q := NewTaskQueeu()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	done := make(chan *Result)
+	go func() {
+		done <- q.ExecContext(context.Background(), "k", func() (interface{}, error) {
+			<-block
+			return nil, nil
+		})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Destory()
+	q.Destory()
+
+	if res := <-done; res.Err != ErrDestoried {
+		t.Errorf("err: %v, want %v", res.Err, ErrDestoried)
+	}
+	if _, err := q.Exec("k", nil); err != ErrDestoried {
+		t.Errorf("err: %v, want %v", err, ErrDestoried)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	q := NewTaskQueeu()
+
+	done := make(chan *Result)
+	go func() {
+		done <- q.ExecContext(context.Background(), "k", func() (interface{}, error) {
+			time.Sleep(20 * time.Millisecond)
+			return 1, nil
+		})
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil || res.Value.(int) != 1 {
+		t.Errorf("result: %v %v, want 1 nil", res.Value, res.Err)
+	}
+}
@@ -1,87 +1,97 @@
 package timedmap
 
 import (
+	"io"
 	"time"
 )
 
-type Section interface {
+type Section[K comparable, V any] interface {
 	Ident() int
-	Set(key, value interface{}, expiresAfter time.Duration, cb ...callback)
-	GetValue(key interface{}) interface{}
-	GetExpires(key interface{}) (time.Time, error)
-	SetExpires(key interface{}, d time.Duration) error
-	Contains(key interface{}) bool
-	Remove(key interface{})
-	Refresh(key interface{}, d time.Duration) error
+	Set(key K, value V, expiresAfter time.Duration, cb ...Callback[K, V])
+	GetValue(key K) V
+	Get(key K) (V, bool)
+	GetAndRefresh(key K, d time.Duration) (V, bool)
+	GetExpires(key K) (time.Time, error)
+	SetExpires(key K, d time.Duration) error
+	Contains(key K) bool
+	Remove(key K)
+	Refresh(key K, d time.Duration) error
 	Flush()
 	Size() (i int)
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader, cb ...Callback[K, V]) error
 }
 
-type section struct {
-	tm  *TimedMap
+type section[K comparable, V any] struct {
+	tm  *TimedMap[K, V]
 	sec int
 }
 
-func newSection(tm *TimedMap, sec int) *section {
-	return &section{
+func newSection[K comparable, V any](tm *TimedMap[K, V], sec int) *section[K, V] {
+	return &section[K, V]{
 		tm:  tm,
 		sec: sec,
 	}
 }
 
-func (s *section) Ident() int {
+func (s *section[K, V]) Ident() int {
 	return s.sec
 }
 
-func (s *section) Set(key, value interface{}, expiresAfter time.Duration, cb ...callback) {
+func (s *section[K, V]) Set(key K, value V, expiresAfter time.Duration, cb ...Callback[K, V]) {
 	s.tm.set(key, s.sec, value, expiresAfter, cb...)
 }
 
-func (s *section) GetValue(key interface{}) interface{} {
-	v := s.tm.get(key, s.sec)
-	if v == nil {
-		return nil
-	}
-	return v.value
+func (s *section[K, V]) GetValue(key K) V {
+	v, _ := s.tm.getValue(key, s.sec)
+	return v
 }
 
-func (s *section) GetExpires(key interface{}) (time.Time, error) {
-	v := s.tm.get(key, s.sec)
-	if v == nil {
-		return time.Time{}, ErrKeyNotFound
-	}
-	return v.expires, nil
+func (s *section[K, V]) Get(key K) (V, bool) {
+	return s.tm.getValue(key, s.sec)
+}
+
+func (s *section[K, V]) GetAndRefresh(key K, d time.Duration) (V, bool) {
+	return s.tm.getAndRefresh(key, s.sec, d)
+}
+
+func (s *section[K, V]) GetExpires(key K) (time.Time, error) {
+	return s.tm.getExpires(key, s.sec)
 }
 
-func (s *section) SetExpires(key interface{}, d time.Duration) error {
+func (s *section[K, V]) SetExpires(key K, d time.Duration) error {
 	return s.tm.setExpire(key, s.sec, d)
 }
 
-func (s *section) Contains(key interface{}) bool {
-	return s.tm.get(key, s.sec) != nil
+func (s *section[K, V]) Contains(key K) bool {
+	_, ok := s.tm.getValue(key, s.sec)
+	return ok
 }
 
-func (s *section) Remove(key interface{}) {
+func (s *section[K, V]) Remove(key K) {
 	s.tm.remove(key, s.sec)
 }
 
-func (s *section) Refresh(key interface{}, d time.Duration) error {
+func (s *section[K, V]) Refresh(key K, d time.Duration) error {
 	return s.tm.refresh(key, s.sec, d)
 }
 
-func (s *section) Flush() {
-	for k := range s.tm.container {
-		if k.sec == s.sec {
-			s.tm.remove(k.key, k.sec)
-		}
-	}
+func (s *section[K, V]) Flush() {
+	s.tm.flushSection(s.sec)
 }
 
-func (s *section) Size() (i int) {
-	for k := range s.tm.container {
-		if k.sec == s.sec {
-			i++
-		}
-	}
-	return
+func (s *section[K, V]) Size() (i int) {
+	return s.tm.sizeSection(s.sec)
+}
+
+// Snapshot writes the live entries of this section only
+func (s *section[K, V]) Snapshot(w io.Writer) error {
+	return s.tm.snapshot(w, func(sec int) bool {
+		return sec == s.sec
+	})
+}
+
+// Restore loads every entry of the snapshot into this section
+func (s *section[K, V]) Restore(r io.Reader, cb ...Callback[K, V]) error {
+	return s.tm.restore(r, s.sec, true, cb...)
 }
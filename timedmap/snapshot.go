@@ -0,0 +1,111 @@
+package timedmap
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const snapshotVersion = 1
+
+var (
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+type snapshotHeader struct {
+	Version int
+	SavedAt time.Time
+}
+
+type snapshotEntry[K comparable, V any] struct {
+	Sec   int
+	Key   K
+	Value V
+	TTL   time.Duration // remaining time to live when the snapshot was taken
+}
+
+// Snapshot writes all live entries with their remaining TTLs to w using encoding/gob.
+// Callbacks are not saved, interface{} keys and values must be registered with gob.Register.
+func (tm *TimedMap[K, V]) Snapshot(w io.Writer) error {
+	return tm.snapshot(w, func(sec int) bool {
+		return true
+	})
+}
+
+// Restore loads the entries written by Snapshot into their sections, entries that expired
+// in the meantime are skipped and existing keys are replaced. cb is set on every restored entry.
+func (tm *TimedMap[K, V]) Restore(r io.Reader, cb ...Callback[K, V]) error {
+	return tm.restore(r, 0, false, cb...)
+}
+
+func (tm *TimedMap[K, V]) snapshot(w io.Writer, match func(sec int) bool) error {
+	now := time.Now()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, SavedAt: now}); err != nil {
+		return err
+	}
+
+	for _, s := range tm.shards {
+		var entries []snapshotEntry[K, V]
+
+		s.mtx.Lock()
+		for k, v := range s.container {
+			if !match(k.sec) || now.After(v.expires) {
+				continue
+			}
+			entries = append(entries, snapshotEntry[K, V]{
+				Sec:   k.sec,
+				Key:   k.key,
+				Value: v.value,
+				TTL:   v.expires.Sub(now),
+			})
+		}
+		s.mtx.Unlock()
+
+		// encode without the lock, w may be slow
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restore loads a snapshot, with toSec every entry goes into section sec
+func (tm *TimedMap[K, V]) restore(r io.Reader, sec int, toSec bool, cb ...Callback[K, V]) error {
+	dec := gob.NewDecoder(r)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("%w: %d", ErrSnapshotVersion, header.Version)
+	}
+
+	// time spent on disk counts against the remaining TTLs
+	elapsed := time.Since(header.SavedAt)
+	for {
+		var entry snapshotEntry[K, V]
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ttl := entry.TTL - elapsed
+		if ttl <= 0 {
+			continue
+		}
+		if toSec {
+			entry.Sec = sec
+		}
+		tm.set(entry.Key, entry.Sec, entry.Value, ttl, cb...)
+	}
+}
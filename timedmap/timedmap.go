@@ -1,7 +1,10 @@
 package timedmap
 
 import (
+	"container/heap"
+	"container/list"
 	"errors"
+	"hash/maphash"
 	"sync"
 	"time"
 )
@@ -10,31 +13,145 @@ var (
 	ErrKeyNotFound = errors.New("key not found")
 )
 
-type callback func(value interface{})
+const defaultShards = 32
+
+// Reason tells a callback why an entry left the map
+type Reason int
+
+const (
+	ReasonExpired  Reason = iota // the entry outlived its expiry
+	ReasonRemoved                // Remove or Flush was called
+	ReasonReplaced               // Set was called again on the key
+	ReasonEvicted                // the least recently used entry was dropped to honour the max entries
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonExpired:
+		return "expired"
+	case ReasonRemoved:
+		return "removed"
+	case ReasonReplaced:
+		return "replaced"
+	case ReasonEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+// Callback is called with the entry that left the map and the reason why
+type Callback[K comparable, V any] func(key K, value V, reason Reason)
+
+type Option func(o *options)
+
+type options struct {
+	shards     int
+	maxEntries int
+}
+
+// WithShards sets the number of independently locked shards, default 32
+func WithShards(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.shards = n
+		}
+	}
+}
+
+// WithMaxEntries bounds the map size, the least recently used entries are evicted beyond it.
+// The map keeps a single shard then, so the bound and the lru order are exact.
+func WithMaxEntries(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxEntries = n
+		}
+	}
+}
+
+// TimedMap is a map whose entries expire after a duration.
+//
+// Expiries are kept in a min-heap per shard, so a cleanup only touches
+// the entries that actually expired.
+type TimedMap[K comparable, V any] struct {
+	shards []*shard[K, V]
+	seed   maphash.Seed // spreads the keys over the shards
 
-type TimedMap struct {
-	mtx             sync.RWMutex
-	container       map[keyWrap]*element
-	cleanupTickTime time.Duration
 	cleaner         *time.Ticker
-	cleanerStopChan chan bool
+	cleanerStopChan chan struct{}
+	cleanerStopOnce sync.Once
 }
 
-type keyWrap struct {
+type keyWrap[K comparable] struct {
 	sec int
-	key interface{}
+	key K
 }
 
-type element struct {
-	value   interface{}
+type element[K comparable, V any] struct {
+	key     keyWrap[K]
+	value   V
 	expires time.Time
-	cbs     []callback
+	cbs     []Callback[K, V]
+	index   int           // position in the shard expiry heap
+	lru     *list.Element // position in the shard lru list, nil without max entries
 }
 
-func New(cleanupTickTime time.Duration) *TimedMap {
-	tm := &TimedMap{
-		container:       make(map[keyWrap]*element),
-		cleanerStopChan: make(chan bool),
+type shard[K comparable, V any] struct {
+	mtx       sync.Mutex
+	container map[keyWrap[K]]*element[K, V]
+	expiries  expiryHeap[K, V]
+	lru       *list.List // front is the most recently used
+	max       int
+}
+
+// event is a callback invocation collected under the shard lock and run after it
+type event[K comparable, V any] struct {
+	key    K
+	value  V
+	cbs    []Callback[K, V]
+	reason Reason
+}
+
+func fire[K comparable, V any](events []event[K, V]) {
+	for _, e := range events {
+		for _, cb := range e.cbs {
+			cb(e.key, e.value, e.reason)
+		}
+	}
+}
+
+func newEvent[K comparable, V any](v *element[K, V], reason Reason) event[K, V] {
+	return event[K, V]{key: v.key.key, value: v.value, cbs: v.cbs, reason: reason}
+}
+
+// New returns a TimedMap with interface{} keys and values
+func New(cleanupTickTime time.Duration, opts ...Option) *TimedMap[interface{}, interface{}] {
+	return NewTyped[interface{}, interface{}](cleanupTickTime, opts...)
+}
+
+// NewTyped returns a TimedMap with typed keys and values
+func NewTyped[K comparable, V any](cleanupTickTime time.Duration, opts ...Option) *TimedMap[K, V] {
+	o := &options{shards: defaultShards}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.maxEntries > 0 {
+		o.shards = 1
+	}
+
+	tm := &TimedMap[K, V]{
+		shards:          make([]*shard[K, V], o.shards),
+		seed:            maphash.MakeSeed(),
+		cleanerStopChan: make(chan struct{}),
+	}
+	for i := range tm.shards {
+		tm.shards[i] = &shard[K, V]{
+			container: make(map[keyWrap[K]]*element[K, V]),
+		}
+		if o.maxEntries > 0 {
+			tm.shards[i].lru = list.New()
+			tm.shards[i].max = o.maxEntries
+		}
 	}
 
 	tm.cleaner = time.NewTicker(cleanupTickTime)
@@ -45,7 +162,7 @@ func New(cleanupTickTime time.Duration) *TimedMap {
 			case <-tm.cleaner.C:
 				tm.cleanUp()
 			case <-tm.cleanerStopChan:
-				break
+				return
 			}
 		}
 	}()
@@ -53,173 +170,345 @@ func New(cleanupTickTime time.Duration) *TimedMap {
 	return tm
 }
 
-func (tm *TimedMap) Section(i int) Section {
+func (tm *TimedMap[K, V]) Section(i int) Section[K, V] {
 	return newSection(tm, i)
 }
 
-func (tm *TimedMap) Ident() int {
+func (tm *TimedMap[K, V]) Ident() int {
 	return 0
 }
 
-func (tm *TimedMap) Set(key, value interface{}, expiresAfter time.Duration, cb ...callback) {
+func (tm *TimedMap[K, V]) Set(key K, value V, expiresAfter time.Duration, cb ...Callback[K, V]) {
 	tm.set(key, 0, value, expiresAfter, cb...)
 }
 
-func (tm *TimedMap) GetValue(key interface{}) interface{} {
-	v := tm.get(key, 0)
-	if v == nil {
-		return nil
-	}
-	return v.value
+func (tm *TimedMap[K, V]) GetValue(key K) V {
+	v, _ := tm.getValue(key, 0)
+	return v
 }
 
-func (tm *TimedMap) GetExpires(key interface{}) (time.Time, error) {
-	v := tm.get(key, 0)
-	if v == nil {
-		return time.Time{}, ErrKeyNotFound
-	}
-	return v.expires, nil
+// Get returns the value and whether the key was found, which GetValue can not tell for zero values
+func (tm *TimedMap[K, V]) Get(key K) (V, bool) {
+	return tm.getValue(key, 0)
+}
+
+// GetAndRefresh returns the value and moves its expiry to d from now, for sliding expiries
+func (tm *TimedMap[K, V]) GetAndRefresh(key K, d time.Duration) (V, bool) {
+	return tm.getAndRefresh(key, 0, d)
+}
+
+func (tm *TimedMap[K, V]) GetExpires(key K) (time.Time, error) {
+	return tm.getExpires(key, 0)
 }
 
-func (tm *TimedMap) SetExpire(key interface{}, d time.Duration) error {
+func (tm *TimedMap[K, V]) SetExpire(key K, d time.Duration) error {
 	return tm.setExpire(key, 0, d)
 }
 
-func (tm *TimedMap) Contains(key interface{}) bool {
-	return tm.get(key, 0) != nil
+func (tm *TimedMap[K, V]) Contains(key K) bool {
+	_, ok := tm.getValue(key, 0)
+	return ok
 }
 
-func (tm *TimedMap) Remove(key interface{}) {
+func (tm *TimedMap[K, V]) Remove(key K) {
 	tm.remove(key, 0)
 }
 
-func (tm *TimedMap) Refresh(key interface{}, d time.Duration) error {
+func (tm *TimedMap[K, V]) Refresh(key K, d time.Duration) error {
 	return tm.refresh(key, 0, d)
 }
 
-func (tm *TimedMap) Flush() {
-	tm.container = make(map[keyWrap]*element)
+func (tm *TimedMap[K, V]) Flush() {
+	for _, s := range tm.shards {
+		var events []event[K, V]
+
+		s.mtx.Lock()
+		for _, v := range s.container {
+			if len(v.cbs) > 0 {
+				events = append(events, newEvent(v, ReasonRemoved))
+			}
+		}
+		s.container = make(map[keyWrap[K]]*element[K, V])
+		s.expiries = nil
+		if s.lru != nil {
+			s.lru.Init()
+		}
+		s.mtx.Unlock()
+
+		fire(events)
+	}
 }
 
-func (tm *TimedMap) Size() int {
-	return len(tm.container)
+func (tm *TimedMap[K, V]) Size() (i int) {
+	for _, s := range tm.shards {
+		s.mtx.Lock()
+		i += len(s.container)
+		s.mtx.Unlock()
+	}
+	return
 }
 
-func (tm *TimedMap) StopCleaner() {
-	go func() {
-		tm.cleanerStopChan <- true
-	}()
-	tm.cleaner.Stop()
+// StopCleaner stops the background cleanup, expired entries are then only dropped on access
+func (tm *TimedMap[K, V]) StopCleaner() {
+	tm.cleanerStopOnce.Do(func() {
+		tm.cleaner.Stop()
+		close(tm.cleanerStopChan)
+	})
 }
 
-func (tm *TimedMap) expireElement(key interface{}, sec int, v *element) {
-	for _, cb := range v.cbs {
-		cb(v.value)
+func (tm *TimedMap[K, V]) shard(k keyWrap[K]) *shard[K, V] {
+	if len(tm.shards) == 1 {
+		return tm.shards[0]
 	}
+	return tm.shards[maphash.Comparable(tm.seed, k)%uint64(len(tm.shards))]
+}
 
-	k := keyWrap{
-		sec: sec,
-		key: key,
+// removeElement drops v from its shard, the shard lock must be held
+func (s *shard[K, V]) removeElement(v *element[K, V]) {
+	delete(s.container, v.key)
+	if v.index >= 0 {
+		heap.Remove(&s.expiries, v.index)
+	}
+	if v.lru != nil {
+		s.lru.Remove(v.lru)
+		v.lru = nil
+	}
+}
+
+// touch marks v as the most recently used entry
+func (s *shard[K, V]) touch(v *element[K, V]) {
+	if v.lru != nil {
+		s.lru.MoveToFront(v.lru)
+	}
+}
+
+// lookup returns the live element on k, an expired one is removed and reported in the event
+func (s *shard[K, V]) lookup(k keyWrap[K]) (*element[K, V], []event[K, V]) {
+	v, ok := s.container[k]
+	if !ok {
+		return nil, nil
 	}
 
-	delete(tm.container, k)
+	if time.Now().After(v.expires) {
+		s.removeElement(v)
+		return nil, []event[K, V]{newEvent(v, ReasonExpired)}
+	}
+	return v, nil
 }
 
-func (tm *TimedMap) cleanUp() {
+func (tm *TimedMap[K, V]) cleanUp() {
 	now := time.Now()
 
-	tm.mtx.Lock()
-	defer tm.mtx.Unlock()
+	for _, s := range tm.shards {
+		var events []event[K, V]
 
-	for k, v := range tm.container {
-		if now.After(v.expires) {
-			tm.expireElement(k.key, k.sec, v)
+		s.mtx.Lock()
+		for len(s.expiries) > 0 && now.After(s.expiries[0].expires) {
+			v := s.expiries[0]
+			s.removeElement(v)
+			events = append(events, newEvent(v, ReasonExpired))
 		}
+		s.mtx.Unlock()
+
+		// callbacks run without the lock so they may use the map
+		fire(events)
 	}
 }
 
-func (tm *TimedMap) set(key interface{}, sec int, val interface{}, expiresAfter time.Duration, cb ...callback) {
+func (tm *TimedMap[K, V]) set(key K, sec int, val V, expiresAfter time.Duration, cb ...Callback[K, V]) {
+	k := keyWrap[K]{
+		sec: sec,
+		key: key,
+	}
+	s := tm.shard(k)
+
+	var events []event[K, V]
+	defer func() {
+		fire(events)
+	}()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
 	// re-use element when existent on this key
-	if v := tm.getRaw(key, sec); v != nil {
+	if v, ok := s.container[k]; ok {
+		if len(v.cbs) > 0 {
+			events = append(events, newEvent(v, ReasonReplaced))
+		}
 		v.value = val
 		v.expires = time.Now().Add(expiresAfter)
 		v.cbs = cb
+		heap.Fix(&s.expiries, v.index)
+		s.touch(v)
 		return
 	}
 
-	k := keyWrap{
-		sec: sec,
-		key: key,
-	}
-
-	tm.mtx.Lock()
-	defer tm.mtx.Unlock()
-
-	tm.container[k] = &element{
+	v := &element[K, V]{
+		key:     k,
 		value:   val,
 		expires: time.Now().Add(expiresAfter),
 		cbs:     cb,
 	}
+	s.container[k] = v
+	heap.Push(&s.expiries, v)
+
+	if s.lru == nil {
+		return
+	}
+	v.lru = s.lru.PushFront(v)
+	for s.lru.Len() > s.max {
+		oldest := s.lru.Back().Value.(*element[K, V])
+		s.removeElement(oldest)
+		events = append(events, newEvent(oldest, ReasonEvicted))
+	}
 }
 
-func (tm *TimedMap) get(key interface{}, sec int) *element {
-	v := tm.getRaw(key, sec)
+// get returns a copy of the live element on key, or nil
+func (tm *TimedMap[K, V]) get(key K, sec int) *element[K, V] {
+	var cp *element[K, V]
+	tm.update(key, sec, func(v *element[K, V]) {
+		c := *v
+		cp = &c
+	})
+	return cp
+}
 
+func (tm *TimedMap[K, V]) getValue(key K, sec int) (V, bool) {
+	v := tm.get(key, sec)
 	if v == nil {
-		return nil
+		var zero V
+		return zero, false
 	}
+	return v.value, true
+}
 
-	if time.Now().After(v.expires) {
-		tm.expireElement(key, sec, v)
-		return nil
-	}
+func (tm *TimedMap[K, V]) getAndRefresh(key K, sec int, d time.Duration) (V, bool) {
+	var (
+		val V
+		ok  bool
+	)
+	tm.update(key, sec, func(v *element[K, V]) {
+		v.expires = time.Now().Add(d)
+		val, ok = v.value, true
+	})
+	return val, ok
+}
 
-	return v
+func (tm *TimedMap[K, V]) getExpires(key K, sec int) (time.Time, error) {
+	v := tm.get(key, sec)
+	if v == nil {
+		return time.Time{}, ErrKeyNotFound
+	}
+	return v.expires, nil
 }
 
-func (tm *TimedMap) getRaw(key interface{}, sec int) *element {
-	k := keyWrap{
+func (tm *TimedMap[K, V]) remove(key K, sec int) {
+	k := keyWrap[K]{
 		sec: sec,
 		key: key,
 	}
+	s := tm.shard(k)
 
-	tm.mtx.RLock()
-	v, ok := tm.container[k]
-	tm.mtx.RUnlock()
-
-	if !ok {
-		return nil
+	s.mtx.Lock()
+	v, ok := s.container[k]
+	if ok {
+		s.removeElement(v)
 	}
+	s.mtx.Unlock()
 
-	return v
+	if ok {
+		fire([]event[K, V]{newEvent(v, ReasonRemoved)})
+	}
 }
 
-func (tm *TimedMap) remove(key interface{}, sec int) {
-	k := keyWrap{
+// update applies fn to the live element on key, marks it as used and fixes its heap position
+func (tm *TimedMap[K, V]) update(key K, sec int, fn func(v *element[K, V])) error {
+	k := keyWrap[K]{
 		sec: sec,
 		key: key,
 	}
+	s := tm.shard(k)
 
-	tm.mtx.Lock()
-	defer tm.mtx.Unlock()
-
-	delete(tm.container, k)
-}
-
-func (tm *TimedMap) refresh(key interface{}, sec int, d time.Duration) error {
-	v := tm.get(key, sec)
+	s.mtx.Lock()
+	v, events := s.lookup(k)
 	if v == nil {
+		s.mtx.Unlock()
+		fire(events)
 		return ErrKeyNotFound
 	}
-	v.expires = v.expires.Add(d)
+
+	fn(v)
+	heap.Fix(&s.expiries, v.index)
+	s.touch(v)
+	s.mtx.Unlock()
 	return nil
 }
 
-func (tm *TimedMap) setExpire(key interface{}, sec int, d time.Duration) error {
-	v := tm.get(key, sec)
-	if v == nil {
-		return ErrKeyNotFound
+func (tm *TimedMap[K, V]) refresh(key K, sec int, d time.Duration) error {
+	return tm.update(key, sec, func(v *element[K, V]) {
+		v.expires = v.expires.Add(d)
+	})
+}
+
+func (tm *TimedMap[K, V]) setExpire(key K, sec int, d time.Duration) error {
+	return tm.update(key, sec, func(v *element[K, V]) {
+		v.expires = time.Now().Add(d)
+	})
+}
+
+func (tm *TimedMap[K, V]) flushSection(sec int) {
+	for _, s := range tm.shards {
+		var events []event[K, V]
+
+		s.mtx.Lock()
+		for k, v := range s.container {
+			if k.sec == sec {
+				s.removeElement(v)
+				events = append(events, newEvent(v, ReasonRemoved))
+			}
+		}
+		s.mtx.Unlock()
+
+		fire(events)
 	}
-	v.expires = time.Now().Add(d)
-	return nil
+}
+
+func (tm *TimedMap[K, V]) sizeSection(sec int) (i int) {
+	for _, s := range tm.shards {
+		s.mtx.Lock()
+		for k := range s.container {
+			if k.sec == sec {
+				i++
+			}
+		}
+		s.mtx.Unlock()
+	}
+	return
+}
+
+// expiryHeap orders elements by their expiry
+type expiryHeap[K comparable, V any] []*element[K, V]
+
+func (h expiryHeap[K, V]) Len() int           { return len(h) }
+func (h expiryHeap[K, V]) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h expiryHeap[K, V]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap[K, V]) Push(x interface{}) {
+	v := x.(*element[K, V])
+	v.index = len(*h)
+	*h = append(*h, v)
+}
+
+func (h *expiryHeap[K, V]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	old[n-1] = nil
+	v.index = -1
+	*h = old[:n-1]
+	return v
 }
@@ -1,6 +1,9 @@
 package timedmap
 
 import (
+	"bytes"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +18,7 @@ func TestNew(t *testing.T) {
 	if tm == nil {
 		t.Fatal("TimedMap was nil")
 	}
-	if s := len(tm.container); s != 0 {
+	if s := tm.Size(); s != 0 {
 		t.Fatalf("map size was %d != 0", s)
 	}
 }
@@ -27,7 +30,7 @@ func TestFlush(t *testing.T) {
 		tm.set(i, 0, 1, time.Hour)
 	}
 	tm.Flush()
-	if s := len(tm.container); s > 0 {
+	if s := tm.Size(); s > 0 {
 		t.Fatalf("size was %d > 0", s)
 	}
 }
@@ -225,13 +228,15 @@ func TestSize(t *testing.T) {
 func TestCallback(t *testing.T) {
 	tm := New(dCleanupTick)
 
-	var cbCalled bool
-	tm.Set(1, 3, 25*time.Millisecond, func(v interface{}) {
-		cbCalled = true
+	var cbCalled int32
+	tm.Set(1, 3, 25*time.Millisecond, func(k, v interface{}, reason Reason) {
+		if k == 1 && v == 3 && reason == ReasonExpired {
+			atomic.StoreInt32(&cbCalled, 1)
+		}
 	})
 
 	time.Sleep(50 * time.Millisecond)
-	if !cbCalled {
+	if atomic.LoadInt32(&cbCalled) == 0 {
 		t.Fatal("callback has not been called")
 	}
 	if v := tm.get(1, 0); v != nil {
@@ -290,6 +295,225 @@ func TestBeforeCleanup(t *testing.T) {
 	}
 }
 
+func TestTyped(t *testing.T) {
+	tm := NewTyped[string, int](dCleanupTick)
+	defer tm.StopCleaner()
+
+	tm.Set("a", 0, time.Hour)
+	if v, ok := tm.Get("a"); !ok || v != 0 {
+		t.Fatalf("Get: %d %v, want 0 true", v, ok)
+	}
+	if _, ok := tm.Get("b"); ok {
+		t.Fatal("non existent key was found")
+	}
+
+	sec := tm.Section(1)
+	sec.Set("a", 1, time.Hour)
+	if tm.GetValue("a") != 0 || sec.GetValue("a") != 1 {
+		t.Fatal("section values are mixed up")
+	}
+	if sec.Size() != 1 || tm.Size() != 2 {
+		t.Fatalf("sizes: %d %d, want 1 2", sec.Size(), tm.Size())
+	}
+	sec.Flush()
+	if tm.Size() != 1 {
+		t.Fatalf("size after section flush: %d, want 1", tm.Size())
+	}
+}
+
+func TestCleanUpOrder(t *testing.T) {
+	tm := NewTyped[int, int](time.Hour, WithShards(1))
+	defer tm.StopCleaner()
+
+	var expired []int
+	for i := 0; i < 10; i++ {
+		tm.Set(i, i, time.Duration(10-i)*time.Millisecond, func(k, v int, reason Reason) {
+			expired = append(expired, v)
+		})
+	}
+	tm.Set(100, 100, time.Hour)
+	if err := tm.Refresh(9, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	tm.cleanUp()
+
+	if len(expired) != 9 || expired[0] != 8 || expired[8] != 0 {
+		t.Fatalf("expired: %v, want 8 down to 0", expired)
+	}
+	if tm.Size() != 2 {
+		t.Fatalf("size: %d, want 2", tm.Size())
+	}
+}
+
+func TestStopCleanerExits(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	tm := New(dCleanupTick)
+	tm.StopCleaner()
+	tm.StopCleaner()
+
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("goroutines: %d > %d, cleaner did not exit", n, before)
+	}
+}
+
+func TestCallbackReasons(t *testing.T) {
+	tm := NewTyped[string, int](time.Hour)
+	defer tm.StopCleaner()
+
+	var reasons []Reason
+	cb := func(k string, v int, reason Reason) {
+		reasons = append(reasons, reason)
+	}
+
+	tm.Set("a", 1, time.Hour, cb)
+	tm.Set("a", 2, time.Hour, cb)
+	tm.Remove("a")
+	tm.Set("b", 1, time.Millisecond, cb)
+	time.Sleep(2 * time.Millisecond)
+	tm.GetValue("b")
+
+	want := []Reason{ReasonReplaced, ReasonRemoved, ReasonExpired}
+	if len(reasons) != len(want) {
+		t.Fatalf("reasons: %v, want %v", reasons, want)
+	}
+	for i := range want {
+		if reasons[i] != want[i] {
+			t.Fatalf("reasons: %v, want %v", reasons, want)
+		}
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	tm := NewTyped[int, int](time.Hour, WithShards(1), WithMaxEntries(3))
+	defer tm.StopCleaner()
+
+	var evicted []int
+	cb := func(k, v int, reason Reason) {
+		if reason == ReasonEvicted {
+			evicted = append(evicted, k)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		tm.Set(i, i, time.Hour, cb)
+	}
+	tm.GetValue(0)
+	tm.Set(3, 3, time.Hour, cb)
+	tm.Set(4, 4, time.Hour, cb)
+
+	if tm.Size() != 3 {
+		t.Fatalf("size: %d, want 3", tm.Size())
+	}
+	if len(evicted) != 2 || evicted[0] != 1 || evicted[1] != 2 {
+		t.Fatalf("evicted: %v, want [1 2]", evicted)
+	}
+	if !tm.Contains(0) {
+		t.Fatal("recently used key was evicted")
+	}
+}
+
+func TestMaxEntriesExact(t *testing.T) {
+	tm := NewTyped[int, int](time.Hour, WithMaxEntries(100))
+	defer tm.StopCleaner()
+
+	evicted := 0
+	for i := 0; i < 100; i++ {
+		tm.Set(i, i, time.Hour, func(k, v int, reason Reason) {
+			if reason == ReasonEvicted {
+				evicted++
+			}
+		})
+	}
+	if tm.Size() != 100 || evicted != 0 {
+		t.Fatalf("size: %d with %d evicted, want all 100 kept", tm.Size(), evicted)
+	}
+
+	tm.Set(100, 100, time.Hour)
+	if tm.Size() != 100 || tm.Contains(0) {
+		t.Fatalf("size: %d, want 100 with the oldest key evicted", tm.Size())
+	}
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	tm := NewTyped[string, int](time.Hour)
+	defer tm.StopCleaner()
+
+	tm.Set("a", 1, 100*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		time.Sleep(40 * time.Millisecond)
+		if v, ok := tm.GetAndRefresh("a", 100*time.Millisecond); !ok || v != 1 {
+			t.Fatalf("GetAndRefresh: %d %v, want 1 true", v, ok)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := tm.GetAndRefresh("a", time.Hour); ok {
+		t.Fatal("key was not expired without access")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tm := NewTyped[string, int](time.Hour)
+	defer tm.StopCleaner()
+
+	tm.Set("a", 1, time.Hour)
+	tm.Set("short", 2, 20*time.Millisecond)
+	tm.Section(1).Set("b", 3, time.Hour)
+
+	var buf bytes.Buffer
+	if err := tm.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	restored := NewTyped[string, int](time.Hour)
+	defer restored.StopCleaner()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Size() != 2 {
+		t.Fatalf("size: %d, want 2", restored.Size())
+	}
+	if restored.GetValue("a") != 1 || restored.Section(1).GetValue("b") != 3 {
+		t.Fatal("restored values differ")
+	}
+	if restored.Contains("short") {
+		t.Fatal("entry expired while saved was restored")
+	}
+
+	exp, _ := restored.GetExpires("a")
+	if d := time.Until(exp); d > time.Hour || d < time.Hour-time.Second {
+		t.Fatalf("remaining ttl was %v, want about 1h", d)
+	}
+}
+
+func TestSectionSnapshot(t *testing.T) {
+	tm := New(time.Hour)
+	defer tm.StopCleaner()
+
+	tm.Set("a", 1, time.Hour)
+	tm.Section(1).Set("b", "x", time.Hour)
+
+	var buf bytes.Buffer
+	if err := tm.Section(1).Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New(time.Hour)
+	defer restored.StopCleaner()
+	if err := restored.Section(2).Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Size() != 1 || restored.Section(2).GetValue("b") != "x" {
+		t.Fatal("section was not restored into section 2")
+	}
+}
+
 // ----------------------------------------------------------
 // --- BENCHMARKS ---
 
@@ -324,3 +548,36 @@ func BenchmarkSetGetSameKey(b *testing.B) {
 		tm.GetValue(1)
 	}
 }
+
+func TestShardStructKeys(t *testing.T) {
+	type session struct {
+		user *int
+		id   int
+	}
+	tm := NewTyped[session, int](time.Hour, WithShards(8))
+	defer tm.StopCleaner()
+
+	// the keys print alike, their pointers differ
+	keys := make([]session, 1000)
+	for i := range keys {
+		keys[i] = session{user: new(int)}
+		tm.Set(keys[i], i, time.Hour)
+	}
+	for i, k := range keys {
+		if v, ok := tm.Get(k); !ok || v != i {
+			t.Fatalf("key %d: %v %v", i, v, ok)
+		}
+	}
+	used := 0
+	for _, s := range tm.shards {
+		if len(s.container) > 0 {
+			used++
+		}
+	}
+	if used < 8 {
+		t.Fatalf("keys spread over %d of 8 shards", used)
+	}
+	if n := testing.AllocsPerRun(100, func() { tm.shard(keyWrap[session]{key: keys[0]}) }); n != 0 {
+		t.Fatalf("shard lookup allocates %v times", n)
+	}
+}